@@ -12,22 +12,39 @@ import (
 var version = "dev"
 
 func main() {
+	hcloudimages.Version = version
+
+	shutdownTracing, err := hcloudimages.SetupTracing(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	p, err := infer.NewProviderBuilder().
 		WithNamespace("hcloud-upload-image").
 		WithDescription("A Pulumi provider for uploading custom images to Hetzner Cloud using https://github.com/apricote/hcloud-upload-image").
 		WithPluginDownloadURL("github://api.github.com/exivity").
 		WithGoImportPath("github.com/exivity/pulumi-hcloud-upload-image/sdk/go/pulumi-hcloud-upload-image").
 		WithLicense("MIT License").
+		WithConfig(infer.Config(&hcloudimages.Config{})).
 		WithResources(
 			infer.Resource(hcloudimages.UploadedImage{}),
 		).
+		WithFunctions(
+			infer.Function(hcloudimages.CleanupKeptResources{}),
+		).
 		Build()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
+	p = hcloudimages.WithURN(hcloudimages.WithTracing(p))
+
 	err = p.Run(context.Background(), "hcloud-upload-image", version)
+	if shutdownErr := shutdownTracing(context.Background()); shutdownErr != nil {
+		fmt.Fprintln(os.Stderr, shutdownErr)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
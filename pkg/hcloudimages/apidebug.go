@@ -0,0 +1,41 @@
+package hcloudimages
+
+import (
+	"regexp"
+	"strings"
+
+	p "github.com/pulumi/pulumi-go-provider"
+)
+
+// redacted replaces secrets in the API debug log
+const redacted = "REDACTED"
+
+var (
+	authorizationHeader = regexp.MustCompile(`(?im)^((?:proxy-)?authorization:[ \t]*)[^\r\n]*`)
+	rootPasswordField   = regexp.MustCompile(`"root_password"\s*:\s*"(?:[^"\\]|\\.)*"`)
+)
+
+// apiDebugWriter passes the request and response dumps of hcloud-go to the Pulumi debug log. hcloud-go
+// already redacts the Authorization header of requests, the writer also removes the token and root
+// passwords from anywhere in the dumps.
+type apiDebugWriter struct {
+	logger  p.Logger
+	secrets []string
+}
+
+func (w apiDebugWriter) Write(b []byte) (int, error) {
+	w.logger.Debug(strings.TrimSpace(redact(string(b), w.secrets)))
+	return len(b), nil
+}
+
+// redact removes authorization headers, root passwords and the given secrets from an HTTP dump
+func redact(dump string, secrets []string) string {
+	dump = authorizationHeader.ReplaceAllString(dump, "${1}"+redacted)
+	dump = rootPasswordField.ReplaceAllString(dump, `"root_password":"`+redacted+`"`)
+	for _, secret := range secrets {
+		if secret != "" {
+			dump = strings.ReplaceAll(dump, secret, redacted)
+		}
+	}
+	return dump
+}
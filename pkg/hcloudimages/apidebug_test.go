@@ -0,0 +1,77 @@
+package hcloudimages
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		dump    string
+		secrets []string
+		want    string
+	}{
+		{
+			name: "authorization header",
+			dump: "GET /v1/images HTTP/1.1\r\nAuthorization: Bearer abc\r\nAccept: */*\r\n",
+			want: "GET /v1/images HTTP/1.1\r\nAuthorization: REDACTED\r\nAccept: */*\r\n",
+		},
+		{
+			name: "header case",
+			dump: "authorization: Bearer abc\nAUTHORIZATION:Bearer abc\n",
+			want: "authorization: REDACTED\nAUTHORIZATION:REDACTED\n",
+		},
+		{
+			name: "proxy authorization header",
+			dump: "Proxy-Authorization: Basic dXNlcjpwYXNz\r\nPROXY-AUTHORIZATION: Basic dXNlcjpwYXNz\r\n",
+			want: "Proxy-Authorization: REDACTED\r\nPROXY-AUTHORIZATION: REDACTED\r\n",
+		},
+		{
+			name: "other headers",
+			dump: "X-Authorization-Hint: none\r\n",
+			want: "X-Authorization-Hint: none\r\n",
+		},
+		{
+			name:    "token in body",
+			dump:    `{"token":"s3cret-token"}`,
+			secrets: []string{"s3cret-token"},
+			want:    `{"token":"REDACTED"}`,
+		},
+		{
+			name:    "token in url",
+			dump:    "GET /v1/images?token=s3cret-token HTTP/1.1\r\n",
+			secrets: []string{"s3cret-token"},
+			want:    "GET /v1/images?token=REDACTED HTTP/1.1\r\n",
+		},
+		{
+			name: "root password",
+			dump: `{"root_password":"hunter2","server":{"id":1}}`,
+			want: `{"root_password":"REDACTED","server":{"id":1}}`,
+		},
+		{
+			name: "root password with spaces around the colon",
+			dump: `{"root_password" : "hunter2", "root_password":` + "\n" + `  "hunter3"}`,
+			want: `{"root_password":"REDACTED", "root_password":"REDACTED"}`,
+		},
+		{
+			name: "root password with escaped quote",
+			dump: `{"root_password":"hun\"ter2","id":1}`,
+			want: `{"root_password":"REDACTED","id":1}`,
+		},
+		{
+			name: "null root password",
+			dump: `{"root_password":null}`,
+			want: `{"root_password":null}`,
+		},
+		{
+			name:    "empty secret",
+			dump:    `{"id":1}`,
+			secrets: []string{""},
+			want:    `{"id":1}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := redact(tc.dump, tc.secrets); got != tc.want {
+				t.Errorf("redact(%q) = %q, expected %q", tc.dump, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package hcloudimages
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	p "github.com/pulumi/pulumi-go-provider"
+	"github.com/pulumi/pulumi-go-provider/infer"
+)
+
+// auditAction is what happened to an image
+type auditAction string
+
+const (
+	auditCreated  auditAction = "created"  // uploaded by Create
+	auditAdopted  auditAction = "adopted"  // created by an interrupted previous run
+	auditReused   auditAction = "reused"   // an existing or concurrently uploaded snapshot was referenced
+	auditUpdated  auditAction = "updated"  // description or labels changed
+	auditDeleted  auditAction = "deleted"  // the snapshot was deleted
+	auditReleased auditAction = "released" // a reference was dropped, other resources still use the snapshot
+)
+
+const (
+	auditFileMode    = 0o600
+	auditHTTPTimeout = 30 * time.Second
+
+	tokenFingerprintLength = 16
+)
+
+// auditRecord is one entry of the audit log
+type auditRecord struct {
+	Time             time.Time   `json:"time"`
+	Action           auditAction `json:"action"`
+	Stack            string      `json:"stack,omitempty"`
+	URN              string      `json:"urn,omitempty"`
+	ImageID          int64       `json:"imageId"`
+	SourceURL        string      `json:"sourceUrl,omitempty"`
+	SourceDigest     string      `json:"sourceDigest"`
+	TokenFingerprint string      `json:"tokenFingerprint"`
+}
+
+// auditFileMu serializes appends to the audit log file of this provider process
+var auditFileMu sync.Mutex
+
+// audit records the action in the audit log if one is configured. Failures to write the record are
+// reported as warnings, the operation itself already happened.
+func audit(ctx context.Context, action auditAction, imageID int64, args UploadedImageArgs, digest string) {
+	config := infer.GetConfig[Config](ctx)
+	target := config.AuditLog
+	if target == nil || *target == "" {
+		return
+	}
+
+	urn, _ := ctx.Value(urnKey{}).(string)
+	record := auditRecord{
+		Time:             time.Now().UTC(),
+		Action:           action,
+		Stack:            stackName(urn),
+		URN:              urn,
+		ImageID:          imageID,
+		SourceDigest:     digest,
+		TokenFingerprint: tokenFingerprint(args.HcloudToken),
+	}
+	if args.ImageURL != nil {
+		record.SourceURL = redactURL(*args.ImageURL)
+	}
+
+	if err := writeAuditRecord(ctx, config.imageHTTPClient(), *target, record); err != nil {
+		p.GetLogger(ctx).Warningf("Failed to write audit record for image %d: %s", imageID, err)
+	}
+}
+
+func writeAuditRecord(ctx context.Context, client *http.Client, target string, record auditRecord) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return postAuditRecord(ctx, client, target, encoded)
+	}
+
+	auditFileMu.Lock()
+	defer auditFileMu.Unlock()
+
+	file, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, auditFileMode)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if _, err := file.Write(append(encoded, '\n')); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to append to audit log: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+	return nil
+}
+
+func postAuditRecord(ctx context.Context, client *http.Client, endpoint string, encoded []byte) error {
+	// The record is written after the operation, even if the operation was cancelled just before
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditHTTPTimeout)
+	defer cancel()
+
+	if err := postJSON(ctx, client, endpoint, encoded, nil); err != nil {
+		return fmt.Errorf("failed to send audit record: %w", err)
+	}
+	return nil
+}
+
+// tokenFingerprint identifies an API token without revealing it
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])[:tokenFingerprintLength]
+}
+
+// stackName returns the stack of a URN of the form urn:pulumi:<stack>::<project>::<type>::<name>
+func stackName(urn string) string {
+	stack, _, found := strings.Cut(strings.TrimPrefix(urn, "urn:pulumi:"), "::")
+	if !found {
+		return ""
+	}
+	return stack
+}
+
+// redactURL masks the password of credentials embedded in the URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,78 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	p "github.com/pulumi/pulumi-go-provider"
+)
+
+// cleanupTimeout bounds the cleanup of temporary resources after the upload was cancelled
+const cleanupTimeout = 5 * time.Minute
+
+// needsCleanup reports whether the temporary resources must be removed after the upload library returned err.
+// The library does not clean up if it was cancelled, timed out or asked to keep the resources. Resources are
+// only kept for failed uploads that were not cancelled by the user.
+func needsCleanup(ctx, uploadCtx context.Context, keep bool, err error) bool {
+	if err == nil {
+		return keep
+	}
+	return uploadCtx.Err() != nil && (!keep || ctx.Err() != nil)
+}
+
+// cleanupOperation deletes the temporary servers and SSH keys of an upload operation, including those kept
+// for debugging
+func cleanupOperation(ctx context.Context, client *hcloud.Client, opID string) error {
+	return cleanupResources(ctx, client, OperationLabel+"="+opID)
+}
+
+// cleanupStaleResources deletes the temporary servers and SSH keys of an upload operation that were not kept
+// for debugging, e.g. those left behind by an interrupted run
+func cleanupStaleResources(ctx context.Context, client *hcloud.Client, opID string) error {
+	return cleanupResources(ctx, client, OperationLabel+"="+opID+",!"+KeptLabel)
+}
+
+// cleanupResources deletes the temporary servers and SSH keys matching the label selector. The upload library
+// cleans up on the context of the upload, which does not work once that context is cancelled, so this
+// runs on a detached context with its own deadline.
+func cleanupResources(ctx context.Context, client *hcloud.Client, selector string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	logger := p.GetLogger(ctx)
+	opts := hcloud.ListOpts{LabelSelector: selector}
+	errs := []error{}
+
+	servers, err := client.Server.AllWithOpts(ctx, hcloud.ServerListOpts{ListOpts: opts})
+	if err != nil {
+		return fmt.Errorf("failed to list temporary servers: %w", err)
+	}
+	for _, server := range servers {
+		result, _, err := client.Server.DeleteWithResult(ctx, server)
+		if err == nil {
+			err = client.Action.WaitFor(ctx, result.Action)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete temporary server %d: %w", server.ID, err))
+			continue
+		}
+		logger.Infof("Cleanup: deleted temporary server %s (%d)", server.Name, server.ID)
+	}
+
+	keys, err := client.SSHKey.AllWithOpts(ctx, hcloud.SSHKeyListOpts{ListOpts: opts})
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("failed to list temporary ssh keys: %w", err))...)
+	}
+	for _, key := range keys {
+		if _, err := client.SSHKey.Delete(ctx, key); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete temporary ssh key %d: %w", key.ID, err))
+			continue
+		}
+		logger.Infof("Cleanup: deleted temporary ssh key %s (%d)", key.Name, key.ID)
+	}
+
+	return errors.Join(errs...)
+}
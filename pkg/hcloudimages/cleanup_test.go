@@ -0,0 +1,77 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestNeedsCleanup(t *testing.T) {
+	errUpload := errors.New("upload failed")
+	for _, tc := range []struct {
+		name      string
+		err       error
+		keep      bool
+		cancelled bool // the user cancelled Create
+		timedOut  bool // a phase timeout cancelled the upload
+		cleanup   bool
+	}{
+		{name: "success", cleanup: false},
+		{name: "success with keep", keep: true, cleanup: true},
+		{name: "failure", err: errUpload, cleanup: false},
+		{name: "failure with keep", err: errUpload, keep: true, cleanup: false},
+		{name: "cancel", err: errUpload, cancelled: true, cleanup: true},
+		{name: "cancel with keep", err: errUpload, keep: true, cancelled: true, cleanup: true},
+		{name: "phase timeout", err: errUpload, timedOut: true, cleanup: true},
+		{name: "phase timeout with keep", err: errUpload, keep: true, timedOut: true, cleanup: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			uploadCtx, cancelUpload := context.WithCancelCause(ctx)
+			defer cancelUpload(nil)
+
+			if tc.cancelled {
+				cancel()
+			}
+			if tc.timedOut {
+				cancelUpload(fmt.Errorf("%w: write phase exceeded 1h", ErrPhaseTimeout))
+			}
+			if got := needsCleanup(ctx, uploadCtx, tc.keep, tc.err); got != tc.cleanup {
+				t.Errorf("expected cleanup %t, got %t", tc.cleanup, got)
+			}
+		})
+	}
+}
+
+func TestCleanupOperationAfterCancel(t *testing.T) {
+	api, client := newFakeAPI(t)
+	api.addServer(1, map[string]string{OperationLabel: "op"})
+	api.addSSHKey(1, map[string]string{OperationLabel: "op"})
+	api.addServer(2, map[string]string{OperationLabel: "op", KeptLabel: "true"})
+	api.addSSHKey(2, map[string]string{OperationLabel: "op", KeptLabel: "true"})
+	api.addServer(3, map[string]string{OperationLabel: "other"})
+
+	// The upload was cancelled, the cleanup still has to run
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := cleanupStaleResources(ctx, client, "op"); err != nil {
+		t.Fatal(err)
+	}
+	servers, keys := api.remaining()
+	if !slices.Equal(servers, []int64{2, 3}) || !slices.Equal(keys, []int64{2}) {
+		t.Errorf("expected the kept resources to remain, servers %v and SSH keys %v remain", servers, keys)
+	}
+
+	if err := cleanupOperation(ctx, client, "op"); err != nil {
+		t.Fatal(err)
+	}
+	servers, keys = api.remaining()
+	if !slices.Equal(servers, []int64{3}) || len(keys) != 0 {
+		t.Errorf("expected all resources of the operation to be removed, servers %v and SSH keys %v remain",
+			servers, keys)
+	}
+}
@@ -0,0 +1,110 @@
+package hcloudimages
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sync"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	p "github.com/pulumi/pulumi-go-provider"
+)
+
+// uploadCall is an upload in progress that identical uploads can wait for
+type uploadCall struct {
+	done   chan struct{}
+	result uploadResult
+	err    error
+}
+
+var (
+	uploadsMu sync.Mutex
+	uploads   = map[string]*uploadCall{}
+)
+
+// uploadKey identifies uploads that result in identical snapshots in the same project. The labels include the
+// source digest, only the operation label is left out as it differs between resources.
+func uploadKey(token string, opts hcloudimages.UploadOptions) (string, error) {
+	key := struct {
+		Token            [sha256.Size]byte
+		ImageURL         string
+		ImageCompression hcloudimages.Compression
+		ImageFormat      hcloudimages.Format
+		ImageSize        int64
+		Architecture     hcloud.Architecture
+		ServerType       string
+		Location         string
+		Description      *string
+		Labels           map[string]string
+		SkipCleanup      bool
+	}{
+		Token:            sha256.Sum256([]byte(token)),
+		ImageCompression: opts.ImageCompression,
+		ImageFormat:      opts.ImageFormat,
+		ImageSize:        opts.ImageSize,
+		Architecture:     opts.Architecture,
+		Description:      opts.Description,
+		Labels:           maps.Clone(opts.Labels),
+		SkipCleanup:      opts.DebugSkipResourceCleanup,
+	}
+	delete(key.Labels, OperationLabel)
+	if opts.ImageURL != nil {
+		key.ImageURL = opts.ImageURL.String()
+	}
+	if opts.ServerType != nil {
+		key.ServerType = opts.ServerType.Name
+	}
+	if opts.Location != nil {
+		key.Location = opts.Location.Name
+	}
+
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash upload options: %w", err)
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// dedupeUpload runs upload unless an identical upload is already running in this provider process. In that case
+// it waits for the running upload and returns its result with shared set. If the running upload fails, upload
+// is run after all.
+func dedupeUpload(
+	ctx context.Context, key string, upload func() (uploadResult, error),
+) (result uploadResult, shared bool, err error) {
+	for {
+		uploadsMu.Lock()
+		call, running := uploads[key]
+		if !running {
+			call = &uploadCall{done: make(chan struct{})}
+			uploads[key] = call
+			uploadsMu.Unlock()
+
+			call.result, call.err = upload()
+
+			uploadsMu.Lock()
+			delete(uploads, key)
+			uploadsMu.Unlock()
+			close(call.done)
+
+			return call.result, false, call.err
+		}
+		uploadsMu.Unlock()
+
+		p.GetLogger(ctx).Info("Waiting for an identical upload in progress")
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return uploadResult{}, false, fmt.Errorf("waiting for identical upload: %w", ctx.Err())
+		}
+
+		if call.err == nil {
+			return call.result, true, nil
+		}
+		p.GetLogger(ctx).Warningf("Identical upload failed, uploading again: %s", call.err)
+	}
+}
@@ -0,0 +1,49 @@
+package hcloudimages
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages"
+)
+
+func TestUploadKey(t *testing.T) {
+	description := "talos"
+	base := hcloudimages.UploadOptions{
+		Description: &description,
+		Labels:      map[string]string{"env": "prod", OperationLabel: "op-1"},
+	}
+	key := func(opts hcloudimages.UploadOptions) string {
+		t.Helper()
+		k, err := uploadKey("token", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	otherOperation := base
+	otherOperation.Labels = maps.Clone(base.Labels)
+	otherOperation.Labels[OperationLabel] = "op-2"
+	if key(base) != key(otherOperation) {
+		t.Error("uploads of different resources do not share a key")
+	}
+
+	otherLabels := base
+	otherLabels.Labels = map[string]string{"env": "dev", OperationLabel: "op-1"}
+	otherDescription := "other"
+	withDescription := base
+	withDescription.Description = &otherDescription
+	keepOnFailure := base
+	keepOnFailure.DebugSkipResourceCleanup = true
+
+	for name, opts := range map[string]hcloudimages.UploadOptions{
+		"labels":        otherLabels,
+		"description":   withDescription,
+		"keepOnFailure": keepOnFailure,
+	} {
+		if key(base) == key(opts) {
+			t.Errorf("uploads with different %s share a key", name)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package hcloudimages
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+)
+
+// fakeAPI is an in-memory Hetzner Cloud API that serves the endpoints used by the provider outside of the
+// upload library
+type fakeAPI struct {
+	t   *testing.T
+	url string
+
+	mu         sync.Mutex
+	images     map[int64]*schema.Image
+	servers    map[int64]*schema.Server
+	sshKeys    map[int64]*schema.SSHKey
+	primaryIPs []schema.PrimaryIP
+	deleted    []int64
+
+	// failActions makes the server actions fail
+	failActions bool
+}
+
+// newFakeAPI starts the fake API and returns it together with a client for it
+func newFakeAPI(t *testing.T, images ...schema.Image) (*fakeAPI, *hcloud.Client) {
+	t.Helper()
+
+	api := &fakeAPI{
+		t:       t,
+		images:  map[int64]*schema.Image{},
+		servers: map[int64]*schema.Server{},
+		sshKeys: map[int64]*schema.SSHKey{},
+	}
+	for _, image := range images {
+		api.images[image.ID] = &image
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /images", api.listImages)
+	mux.HandleFunc("GET /images/{id}", api.getImage)
+	mux.HandleFunc("PUT /images/{id}", api.updateImage)
+	mux.HandleFunc("DELETE /images/{id}", api.deleteImage)
+	mux.HandleFunc("GET /servers", api.listServers)
+	mux.HandleFunc("GET /servers/{id}", api.getServer)
+	mux.HandleFunc("PUT /servers/{id}", api.updateServer)
+	mux.HandleFunc("DELETE /servers/{id}", api.deleteServer)
+	mux.HandleFunc("POST /servers/{id}/actions/{action}", api.serverAction)
+	mux.HandleFunc("GET /ssh_keys", api.listSSHKeys)
+	mux.HandleFunc("POST /ssh_keys", api.createSSHKey)
+	mux.HandleFunc("DELETE /ssh_keys/{id}", api.deleteSSHKey)
+	mux.HandleFunc("GET /primary_ips", api.listPrimaryIPs)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	api.url = server.URL
+
+	client := hcloud.NewClient(
+		hcloud.WithToken("token"),
+		hcloud.WithEndpoint(server.URL),
+		hcloud.WithPollOpts(hcloud.PollOpts{BackoffFunc: hcloud.ConstantBackoff(time.Millisecond)}),
+	)
+	return api, client
+}
+
+// snapshot returns a snapshot with the given labels for newFakeAPI
+func snapshot(id int64, labels map[string]string) schema.Image {
+	return schema.Image{
+		ID:     id,
+		Status: string(hcloud.ImageStatusAvailable),
+		Type:   string(hcloud.ImageTypeSnapshot),
+		Labels: labels,
+	}
+}
+
+// addServer adds a server with the given labels
+func (api *fakeAPI) addServer(id int64, labels map[string]string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.servers[id] = &schema.Server{
+		ID:        id,
+		Name:      "server-" + strconv.FormatInt(id, 10),
+		Status:    string(hcloud.ServerStatusRunning),
+		PublicNet: schema.ServerPublicNet{IPv4: schema.ServerPublicNetIPv4{IP: "203.0.113." + strconv.FormatInt(id, 10)}},
+		Labels:    labels,
+	}
+}
+
+// addSSHKey adds an SSH key with the given labels
+func (api *fakeAPI) addSSHKey(id int64, labels map[string]string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.sshKeys[id] = &schema.SSHKey{ID: id, Name: "key-" + strconv.FormatInt(id, 10), Labels: labels}
+}
+
+// serverLabels returns a copy of the labels of the server
+func (api *fakeAPI) serverLabels(id int64) map[string]string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return maps.Clone(api.servers[id].Labels)
+}
+
+// remaining returns the IDs of the servers and SSH keys that were not deleted
+func (api *fakeAPI) remaining() (servers, sshKeys []int64) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return slices.Sorted(maps.Keys(api.servers)), slices.Sorted(maps.Keys(api.sshKeys))
+}
+
+// addPrimaryIPs adds count primary IPv4 addresses
+func (api *fakeAPI) addPrimaryIPs(count int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for range count {
+		id := int64(len(api.primaryIPs) + 1)
+		ip := "192.0.2." + strconv.FormatInt(id, 10)
+		api.primaryIPs = append(api.primaryIPs, schema.PrimaryIP{ID: id, Type: "ipv4", IP: ip})
+	}
+}
+
+// image returns a copy of the image, or nil if it does not exist
+func (api *fakeAPI) image(id int64) *schema.Image {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	image, ok := api.images[id]
+	if !ok {
+		return nil
+	}
+	clone := *image
+	clone.Labels = maps.Clone(image.Labels)
+	return &clone
+}
+
+func (api *fakeAPI) listImages(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	selector := r.URL.Query().Get("label_selector")
+	statuses := r.URL.Query()["status"]
+	types := r.URL.Query()["type"]
+	images := []schema.Image{}
+	for _, image := range api.images {
+		if matchesSelector(image.Labels, selector) && (len(statuses) == 0 || slices.Contains(statuses, image.Status)) &&
+			(len(types) == 0 || slices.Contains(types, image.Type)) {
+			images = append(images, *image)
+		}
+	}
+	api.write(w, http.StatusOK, schema.ImageListResponse{Images: images})
+}
+
+func (api *fakeAPI) getImage(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	image, ok := api.lookup(w, r)
+	if ok {
+		api.write(w, http.StatusOK, schema.ImageGetResponse{Image: *image})
+	}
+}
+
+func (api *fakeAPI) updateImage(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	image, ok := api.lookup(w, r)
+	if !ok {
+		return
+	}
+	var req schema.ImageUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.t.Errorf("failed to decode image update: %s", err)
+	}
+	if req.Labels != nil {
+		image.Labels = *req.Labels
+	}
+	if req.Description != nil {
+		image.Description = *req.Description
+	}
+	api.write(w, http.StatusOK, schema.ImageUpdateResponse{Image: *image})
+}
+
+func (api *fakeAPI) deleteImage(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	image, ok := api.lookup(w, r)
+	if ok {
+		delete(api.images, image.ID)
+		api.deleted = append(api.deleted, image.ID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (api *fakeAPI) listServers(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	selector := r.URL.Query().Get("label_selector")
+	servers := []schema.Server{}
+	for _, server := range api.servers {
+		if matchesSelector(server.Labels, selector) {
+			servers = append(servers, *server)
+		}
+	}
+	api.write(w, http.StatusOK, schema.ServerListResponse{Servers: servers})
+}
+
+func (api *fakeAPI) getServer(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	server, ok := api.servers[id]
+	if !ok {
+		api.notFound(w)
+		return
+	}
+	api.write(w, http.StatusOK, schema.ServerGetResponse{Server: *server})
+}
+
+func (api *fakeAPI) updateServer(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	server, ok := api.servers[id]
+	if !ok {
+		api.notFound(w)
+		return
+	}
+	var req schema.ServerUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.t.Errorf("failed to decode server update: %s", err)
+	}
+	if req.Labels != nil {
+		server.Labels = *req.Labels
+	}
+	api.write(w, http.StatusOK, schema.ServerUpdateResponse{Server: *server})
+}
+
+// serverAction completes actions like enable_rescue and reset right away
+func (api *fakeAPI) serverAction(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if _, ok := api.servers[id]; !ok {
+		api.notFound(w)
+		return
+	}
+	if api.failActions {
+		api.write(w, http.StatusUnprocessableEntity, schema.ErrorResponse{
+			Error: schema.Error{Code: string(hcloud.ErrorCodeInvalidInput), Message: "action failed"},
+		})
+		return
+	}
+	api.write(w, http.StatusCreated, schema.ServerActionResetResponse{
+		Action: schema.Action{ID: id, Command: r.PathValue("action"), Status: string(hcloud.ActionStatusSuccess)},
+	})
+}
+
+func (api *fakeAPI) deleteServer(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if _, ok := api.servers[id]; !ok {
+		api.notFound(w)
+		return
+	}
+	delete(api.servers, id)
+	api.write(w, http.StatusOK, schema.ServerDeleteResponse{
+		Action: schema.Action{ID: id, Command: "delete_server", Status: string(hcloud.ActionStatusSuccess)},
+	})
+}
+
+func (api *fakeAPI) listSSHKeys(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	selector := r.URL.Query().Get("label_selector")
+	keys := []schema.SSHKey{}
+	for _, key := range api.sshKeys {
+		if matchesSelector(key.Labels, selector) {
+			keys = append(keys, *key)
+		}
+	}
+	api.write(w, http.StatusOK, schema.SSHKeyListResponse{SSHKeys: keys})
+}
+
+func (api *fakeAPI) createSSHKey(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	var req schema.SSHKeyCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.t.Errorf("failed to decode ssh key: %s", err)
+	}
+	key := &schema.SSHKey{ID: int64(100 + len(api.sshKeys)), Name: req.Name, PublicKey: req.PublicKey}
+	if req.Labels != nil {
+		key.Labels = *req.Labels
+	}
+	api.sshKeys[key.ID] = key
+	api.write(w, http.StatusCreated, schema.SSHKeyCreateResponse{SSHKey: *key})
+}
+
+func (api *fakeAPI) deleteSSHKey(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if _, ok := api.sshKeys[id]; !ok {
+		api.notFound(w)
+		return
+	}
+	delete(api.sshKeys, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *fakeAPI) listPrimaryIPs(w http.ResponseWriter, _ *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.write(w, http.StatusOK, schema.PrimaryIPListResponse{PrimaryIPs: api.primaryIPs})
+}
+
+func (api *fakeAPI) lookup(w http.ResponseWriter, r *http.Request) (*schema.Image, bool) {
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	image, ok := api.images[id]
+	if !ok {
+		api.notFound(w)
+	}
+	return image, ok
+}
+
+func (api *fakeAPI) notFound(w http.ResponseWriter) {
+	api.write(w, http.StatusNotFound, schema.ErrorResponse{
+		Error: schema.Error{Code: string(hcloud.ErrorCodeNotFound), Message: "resource not found"},
+	})
+}
+
+func (api *fakeAPI) write(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		api.t.Errorf("failed to encode response: %s", err)
+	}
+}
+
+// matchesSelector supports label selectors of the form key=value,key,!key
+func matchesSelector(labels map[string]string, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	for _, requirement := range strings.Split(selector, ",") {
+		if key, ok := strings.CutPrefix(requirement, "!"); ok {
+			if _, exists := labels[key]; exists {
+				return false
+			}
+			continue
+		}
+		key, value, hasValue := strings.Cut(requirement, "=")
+		if !hasValue {
+			if _, exists := labels[key]; !exists {
+				return false
+			}
+			continue
+		}
+		if actual, ok := labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 	p "github.com/pulumi/pulumi-go-provider"
 	"github.com/pulumi/pulumi-go-provider/infer"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/apricote/hcloud-upload-image/hcloudimages"
 )
@@ -23,6 +27,17 @@ var (
 	ErrUnsupportedArchitecture = errors.New("unsupported architecture")
 	ErrServerTypeNotFound      = errors.New("server type not found")
 	ErrLocationNotFound        = errors.New("location not found")
+	ErrQuotaExceeded           = errors.New("project quota exceeded")
+	ErrImageNotFound           = errors.New("image not found")
+	ErrPhaseTimeout            = errors.New("upload phase timed out")
+	ErrOperationIDRequired     = errors.New("operationId is required")
+	ErrImageShared             = errors.New("image is shared")
+
+	ErrInvalidMaxConcurrentUploads = errors.New("maxConcurrentUploads must not be negative")
+	ErrInvalidTimeout              = errors.New("timeout must not be negative")
+	ErrInvalidHTTPProxy            = errors.New("invalid httpProxy")
+	ErrInvalidCABundle             = errors.New("caBundleFile contains no PEM certificates")
+	ErrRequestRejected             = errors.New("endpoint rejected the request")
 )
 
 // UploadedImage represents a Pulumi resource for uploading custom images to Hetzner Cloud
@@ -36,6 +51,9 @@ type UploadedImageArgs struct {
 	// ImageURL is the URL to download the image from (mutually exclusive with ImageReader)
 	ImageURL *string `pulumi:"imageUrl,optional"`
 
+	// ImageChecksum identifies the content of the image file for reuseExisting
+	ImageChecksum *string `pulumi:"imageChecksum,optional"`
+
 	// ImageCompression describes the compression of the image file
 	ImageCompression *string `pulumi:"imageCompression,optional"`
 
@@ -59,11 +77,20 @@ type UploadedImageArgs struct {
 
 	// Labels will be added to the resulting image
 	Labels map[string]string `pulumi:"labels,optional"`
+
+	// ReuseExisting references an identical existing snapshot instead of uploading the image again
+	ReuseExisting *bool `pulumi:"reuseExisting,optional"`
+
+	// KeepOnFailure keeps the temporary server of a failed upload for debugging
+	KeepOnFailure *bool `pulumi:"keepOnFailure,optional"`
 }
 
 func (args *UploadedImageArgs) Annotate(a infer.Annotator) {
 	a.Describe(&args.HcloudToken, "The Hetzner Cloud API token.")
 	a.Describe(&args.ImageURL, "The URL to download the image from. Must be publicly accessible.")
+	a.Describe(&args.ImageChecksum, "Optional checksum of the image file, e.g. 'sha256:<hex>'. It is not verified "+
+		"against the download, it identifies the image content for 'reuseExisting' when the content behind "+
+		"'imageUrl' can change. Without it, the ETag and size reported by the image host are used.")
 	a.Describe(&args.ImageCompression, "The compression format of the image. Supported: 'none', 'bz2', 'xz'. Defaults to 'none'.")
 	a.Describe(&args.ImageFormat, "The format of the image. Supported: 'raw', 'qcow2'. Defaults to 'raw'.")
 	a.Describe(&args.ImageSize, "Optional size validation for the image in bytes.")
@@ -72,6 +99,14 @@ func (args *UploadedImageArgs) Annotate(a infer.Annotator) {
 	a.Describe(&args.Location, "Optional location to use for the temporary server. Defaults to 'fsn1'.")
 	a.Describe(&args.Description, "Optional description for the resulting image.")
 	a.Describe(&args.Labels, "Labels to add to the resulting image. These can be used to filter images later.")
+	a.Describe(&args.ReuseExisting, "If enabled, an existing snapshot uploaded from the same image URL and content "+
+		"with the same compression, format, architecture, labels and description is referenced instead of uploading "+
+		"the image again. The snapshot is only deleted once no resource references it anymore. The reference count "+
+		"is not updated atomically, resources sharing a snapshot must not be created or deleted concurrently by "+
+		"different Pulumi runs.")
+	a.Describe(&args.KeepOnFailure, "If enabled, the temporary server and SSH key of a failed upload are kept for "+
+		"debugging. The error reports the server, its IP and a private SSH key for its rescue system. "+
+		"Remove them with the cleanupKeptResources function. Defaults to the provider setting.")
 
 	a.SetDefault(&args.ImageCompression, "none")
 	a.SetDefault(&args.ImageFormat, "raw")
@@ -104,6 +139,21 @@ type UploadedImageState struct {
 
 	// Type is the type of the image
 	Type string `pulumi:"type"`
+
+	// UploadDurationSeconds is how long the upload took
+	UploadDurationSeconds float64 `pulumi:"uploadDurationSeconds"`
+
+	// ReportedImageSize is the size of the image file reported by the image host
+	ReportedImageSize int64 `pulumi:"reportedImageSize"`
+
+	// TemporaryServerType is the server type of the temporary server
+	TemporaryServerType string `pulumi:"temporaryServerType"`
+
+	// TemporaryLocation is the location of the temporary server
+	TemporaryLocation string `pulumi:"temporaryLocation"`
+
+	// SourceDigest is a hash of the image URL, compression and the content identifiers of the image
+	SourceDigest string `pulumi:"sourceDigest"`
 }
 
 func (state *UploadedImageState) Annotate(a infer.Annotator) {
@@ -115,12 +165,34 @@ func (state *UploadedImageState) Annotate(a infer.Annotator) {
 	a.Describe(&state.OSVersion, "The OS version of the image.")
 	a.Describe(&state.Status, "The current status of the image.")
 	a.Describe(&state.Type, "The type of the image.")
+	a.Describe(&state.UploadDurationSeconds, "How long the upload took in seconds. 0 if an existing snapshot was used.")
+	a.Describe(&state.ReportedImageSize, "The size of the image file in bytes as reported by the image host "+
+		"in response to a HEAD request after the upload. The transfer itself is not measured. "+
+		"0 if the host does not report the size, e.g. for pre-signed URLs that only allow GET, "+
+		"or if an existing snapshot was used.")
+	a.Describe(&state.TemporaryServerType, "The server type of the temporary server used for the upload.")
+	a.Describe(&state.TemporaryLocation, "The location of the temporary server used for the upload.")
+	a.Describe(&state.SourceDigest, "A hash of the image URL, the compression and the 'imageChecksum' input, "+
+		"or else the ETag and size reported by the image host. It does not hash the image content itself. "+
+		"Snapshots with the same hash, architecture and format are reused by 'reuseExisting'.")
+}
+
+// setImage copies the attributes of the Hetzner Cloud image into the state
+func (state *UploadedImageState) setImage(image *hcloud.Image) {
+	state.ImageID = image.ID
+	state.ImageName = image.Name
+	state.Created = image.Created.String()
+	state.DiskSize = int(image.DiskSize)
+	state.OSFlavor = image.OSFlavor
+	state.OSVersion = image.OSVersion
+	state.Status = string(image.Status)
+	state.Type = string(image.Type)
 }
 
 // Create uploads a new image to Hetzner Cloud
-func (UploadedImage) Create( //nolint:cyclop,funlen // TODO: refactor this function
+func (UploadedImage) Create( //nolint:cyclop // sequential upload steps with early returns
 	ctx context.Context, req infer.CreateRequest[UploadedImageArgs],
-) (infer.CreateResponse[UploadedImageState], error) {
+) (resp infer.CreateResponse[UploadedImageState], err error) {
 	name := req.Name
 	inputs := req.Inputs
 
@@ -139,14 +211,204 @@ func (UploadedImage) Create( //nolint:cyclop,funlen // TODO: refactor this funct
 		return infer.CreateResponse[UploadedImageState]{ID: name, Output: state}, nil
 	}
 
+	// Report the result to the configured webhooks
+	start := time.Now()
+	defer func() { notifyCreate(ctx, infer.GetConfig[Config](ctx), name, start, resp.Output.ImageID, err) }()
+
 	// Create Hetzner Cloud client
-	hcloudClient := hcloud.NewClient(hcloud.WithToken(inputs.HcloudToken))
-	client := hcloudimages.NewClient(hcloudClient)
+	hcloudClient := newHcloudClient(ctx, inputs.HcloudToken)
+	state.SourceDigest = sourceDigest(inputs, sourceValidators(ctx, inputs))
+
+	opID, err := operationID(ctx, name, inputs)
+	if err != nil {
+		return infer.CreateResponse[UploadedImageState]{}, err
+	}
+	existing, action, err := existingImage(ctx, hcloudClient, opID, inputs, state.SourceDigest)
+	if err != nil {
+		return infer.CreateResponse[UploadedImageState]{}, err
+	}
+	if existing != nil {
+		audit(ctx, action, existing.ID, inputs, state.SourceDigest)
+		state.setImage(existing)
+		return infer.CreateResponse[UploadedImageState]{
+			ID:     strconv.FormatInt(existing.ID, 10),
+			Output: state,
+		}, nil
+	}
+
+	uploadOpts, err := buildUploadOptions(ctx, hcloudClient, inputs)
+	if err != nil {
+		return infer.CreateResponse[UploadedImageState]{}, err
+	}
+	maps.Copy(uploadOpts.Labels, provenanceLabels(inputs, state.SourceDigest))
+	uploadOpts.Labels[ReferencesLabel] = "1"
+	uploadOpts.Labels[OperationLabel] = opID
+
+	// Keep the temporary resources if the upload fails, see keepForDebugging
+	if inputs.KeepOnFailure != nil {
+		uploadOpts.DebugSkipResourceCleanup = *inputs.KeepOnFailure
+	} else if keep := infer.GetConfig[Config](ctx).KeepOnFailure; keep != nil {
+		uploadOpts.DebugSkipResourceCleanup = *keep
+	}
+
+	result, shared, err := uploadOrShare(ctx, hcloudClient, inputs, uploadOpts)
+	if err != nil {
+		return infer.CreateResponse[UploadedImageState]{}, err
+	}
+	image, action := result.image, auditCreated
+	if shared {
+		action = auditReused
+		image, err = updateReferences(ctx, hcloudClient, image, 1)
+		if err != nil {
+			return infer.CreateResponse[UploadedImageState]{}, err
+		}
+		p.GetLogger(ctx).Infof("Sharing snapshot %d with an identical upload, now referenced by %d resources",
+			image.ID, references(image))
+	}
+
+	audit(ctx, action, image.ID, inputs, state.SourceDigest)
+
+	// Populate state with image information
+	state.setImage(image)
+	state.setMetrics(result.metrics)
+
+	return infer.CreateResponse[UploadedImageState]{
+		ID:     strconv.FormatInt(image.ID, 10),
+		Output: state,
+	}, nil
+}
+
+// uploadOrShare uploads the image. Identical uploads running in parallel share one snapshot, the upload key
+// covers their labels and description, so the snapshot matches the inputs of every resource that references it.
+func uploadOrShare(
+	ctx context.Context, hcloudClient *hcloud.Client, inputs UploadedImageArgs, uploadOpts hcloudimages.UploadOptions,
+) (uploadResult, bool, error) {
+	key, err := uploadKey(inputs.HcloudToken, uploadOpts)
+	if err != nil {
+		return uploadResult{}, false, err
+	}
+	return dedupeUpload(ctx, key, func() (uploadResult, error) {
+		return upload(ctx, hcloudClient, uploadOpts)
+	})
+}
+
+// existingImage returns the snapshot Create can use without uploading the image, or nil if there is none
+func existingImage(
+	ctx context.Context, hcloudClient *hcloud.Client, opID string, inputs UploadedImageArgs, digest string,
+) (*hcloud.Image, auditAction, error) {
+	// Adopt the snapshot of a previous run that was interrupted before Create returned
+	image, err := findOperationImage(ctx, hcloudClient, opID)
+	if err != nil {
+		return nil, "", err
+	}
+	if image != nil {
+		// The interrupted run did not get to remove its temporary server and SSH key
+		if err := cleanupStaleResources(ctx, hcloudClient, opID); err != nil {
+			p.GetLogger(ctx).Warningf("Cleanup of temporary resources of the interrupted run failed: %s", err)
+		}
+		image, err = completeOperation(ctx, hcloudClient, image)
+		return image, auditAdopted, err
+	}
+
+	// Reference an identical snapshot instead of uploading the image again
+	if inputs.ReuseExisting != nil && *inputs.ReuseExisting {
+		image, err = reuseImage(ctx, hcloudClient, inputs, digest)
+		return image, auditReused, err
+	}
+	return nil, "", nil
+}
+
+// upload runs the upload of the image once an upload slot is available and the project quota allows it
+func upload(
+	ctx context.Context, hcloudClient *hcloud.Client, uploadOpts hcloudimages.UploadOptions,
+) (uploadResult, error) {
+	config := infer.GetConfig[Config](ctx)
+
+	// Wait for a free upload slot, see Config.MaxConcurrentUploads
+	release, err := config.acquireUploadSlot(ctx)
+	if err != nil {
+		return uploadResult{}, err
+	}
+	defer release()
+
+	// A run of the same operation that was interrupted before the snapshot was created leaves its temporary
+	// server and SSH key behind
+	opID := uploadOpts.Labels[OperationLabel]
+	if err := cleanupStaleResources(ctx, hcloudClient, opID); err != nil {
+		p.GetLogger(ctx).Warningf("Cleanup of temporary resources of an interrupted run failed: %s", err)
+	}
+
+	// Fail before creating any temporary resources if the project is out of quota
+	if err := checkQuota(ctx, hcloudClient, config); err != nil {
+		return uploadResult{}, err
+	}
+
+	uploadCtx, phases := trackPhases(ctx, hcloudClient, config.phaseTimeouts)
+	defer phases.stop()
+
+	start := time.Now()
+	keep := uploadOpts.DebugSkipResourceCleanup
+
+	image, err := hcloudimages.NewClient(hcloudClient).Upload(uploadCtx, uploadOpts)
+
+	if needsCleanup(ctx, uploadCtx, keep, err) {
+		if cleanupErr := cleanupStaleResources(ctx, hcloudClient, opID); cleanupErr != nil {
+			p.GetLogger(context.WithoutCancel(ctx)).Warningf("Cleanup of temporary resources failed: %s", cleanupErr)
+		}
+	}
+
+	if err != nil {
+		err = uploadError(ctx, uploadCtx, phases.phase(), err)
+		if output := phases.remoteOutput(); len(output) > 0 {
+			err = fmt.Errorf("%w\nremote output (last %d lines):\n%s", err, len(output), strings.Join(output, "\n"))
+		}
+		if keep && ctx.Err() == nil {
+			return uploadResult{}, keepForDebugging(ctx, hcloudClient, opID, phases.server(), config.debugKeyDirectory(), err)
+		}
+		return uploadResult{}, err
+	}
+
+	// The snapshot now belongs to this upload, see completeOperation
+	image, err = completeOperation(ctx, hcloudClient, image)
+	if err != nil {
+		return uploadResult{}, err
+	}
+
+	serverType, location := phases.temporaryServer()
+	trace.SpanFromContext(ctx).SetAttributes(serverTypeAttribute.String(serverType), locationAttribute.String(location))
+	return uploadResult{
+		image: image,
+		metrics: uploadMetrics{
+			duration:          time.Since(start),
+			reportedImageSize: contentLength(ctx, uploadOpts.ImageURL.String()),
+			serverType:        serverType,
+			location:          location,
+		},
+	}, nil
+}
 
+// uploadError describes why the upload failed
+func uploadError(ctx, uploadCtx context.Context, phase uploadPhase, err error) error {
+	if cause := context.Cause(uploadCtx); errors.Is(cause, ErrPhaseTimeout) {
+		return fmt.Errorf("failed to upload image: %w", cause)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("failed to upload image: timed out during %s phase: %w", phase, err)
+	}
+	if hcloud.IsError(err, hcloud.ErrorCodeResourceLimitExceeded) {
+		return fmt.Errorf("failed to upload image: %w: %w", ErrQuotaExceeded, err)
+	}
+	return fmt.Errorf("failed to upload image: %w", err)
+}
+
+// buildUploadOptions translates the resource inputs into the options of the upload library
+func buildUploadOptions( //nolint:cyclop // one branch per input
+	ctx context.Context, hcloudClient *hcloud.Client, inputs UploadedImageArgs,
+) (hcloudimages.UploadOptions, error) {
 	// Parse image URL
 	imageURL, err := url.Parse(*inputs.ImageURL)
 	if err != nil {
-		return infer.CreateResponse[UploadedImageState]{}, fmt.Errorf("invalid image URL: %w", err)
+		return hcloudimages.UploadOptions{}, fmt.Errorf("invalid image URL: %w", err)
 	}
 
 	// Build upload options
@@ -164,7 +426,7 @@ func (UploadedImage) Create( //nolint:cyclop,funlen // TODO: refactor this funct
 		case "none", "":
 			uploadOpts.ImageCompression = hcloudimages.CompressionNone
 		default:
-			return infer.CreateResponse[UploadedImageState]{}, fmt.Errorf("%w: %s", ErrUnsupportedCompression, *inputs.ImageCompression)
+			return hcloudimages.UploadOptions{}, fmt.Errorf("%w: %s", ErrUnsupportedCompression, *inputs.ImageCompression)
 		}
 	}
 
@@ -176,7 +438,7 @@ func (UploadedImage) Create( //nolint:cyclop,funlen // TODO: refactor this funct
 		case "raw", "":
 			uploadOpts.ImageFormat = hcloudimages.FormatRaw
 		default:
-			return infer.CreateResponse[UploadedImageState]{}, fmt.Errorf("%w: %s", ErrUnsupportedImageFormat, *inputs.ImageFormat)
+			return hcloudimages.UploadOptions{}, fmt.Errorf("%w: %s", ErrUnsupportedImageFormat, *inputs.ImageFormat)
 		}
 	}
 
@@ -192,17 +454,17 @@ func (UploadedImage) Create( //nolint:cyclop,funlen // TODO: refactor this funct
 	case "arm":
 		uploadOpts.Architecture = hcloud.ArchitectureARM
 	default:
-		return infer.CreateResponse[UploadedImageState]{}, fmt.Errorf("%w: %s", ErrUnsupportedArchitecture, inputs.Architecture)
+		return hcloudimages.UploadOptions{}, fmt.Errorf("%w: %s", ErrUnsupportedArchitecture, inputs.Architecture)
 	}
 
 	// Set server type if specified
 	if inputs.ServerType != nil {
 		serverType, _, err := hcloudClient.ServerType.GetByName(ctx, *inputs.ServerType)
 		if err != nil {
-			return infer.CreateResponse[UploadedImageState]{}, fmt.Errorf("failed to get server type: %w", err)
+			return hcloudimages.UploadOptions{}, fmt.Errorf("failed to get server type: %w", err)
 		}
 		if serverType == nil {
-			return infer.CreateResponse[UploadedImageState]{}, fmt.Errorf("%w: %s", ErrServerTypeNotFound, *inputs.ServerType)
+			return hcloudimages.UploadOptions{}, fmt.Errorf("%w: %s", ErrServerTypeNotFound, *inputs.ServerType)
 		}
 		uploadOpts.ServerType = serverType
 	}
@@ -211,10 +473,10 @@ func (UploadedImage) Create( //nolint:cyclop,funlen // TODO: refactor this funct
 	if inputs.Location != nil {
 		location, _, err := hcloudClient.Location.GetByName(ctx, *inputs.Location)
 		if err != nil {
-			return infer.CreateResponse[UploadedImageState]{}, fmt.Errorf("failed to get location: %w", err)
+			return hcloudimages.UploadOptions{}, fmt.Errorf("failed to get location: %w", err)
 		}
 		if location == nil {
-			return infer.CreateResponse[UploadedImageState]{}, fmt.Errorf("%w: %s", ErrLocationNotFound, *inputs.Location)
+			return hcloudimages.UploadOptions{}, fmt.Errorf("%w: %s", ErrLocationNotFound, *inputs.Location)
 		}
 		uploadOpts.Location = location
 	}
@@ -225,30 +487,10 @@ func (UploadedImage) Create( //nolint:cyclop,funlen // TODO: refactor this funct
 	}
 
 	// Set labels
-	if inputs.Labels != nil {
-		uploadOpts.Labels = inputs.Labels
-	}
-
-	// Upload the image
-	image, err := client.Upload(ctx, uploadOpts)
-	if err != nil {
-		return infer.CreateResponse[UploadedImageState]{}, fmt.Errorf("failed to upload image: %w", err)
-	}
-
-	// Populate state with image information
-	state.ImageID = image.ID
-	state.ImageName = image.Name
-	state.Created = image.Created.String()
-	state.DiskSize = int(image.DiskSize)
-	state.OSFlavor = image.OSFlavor
-	state.OSVersion = image.OSVersion
-	state.Status = string(image.Status)
-	state.Type = string(image.Type)
+	uploadOpts.Labels = make(map[string]string, len(inputs.Labels))
+	maps.Copy(uploadOpts.Labels, inputs.Labels)
 
-	return infer.CreateResponse[UploadedImageState]{
-		ID:     strconv.FormatInt(image.ID, 10),
-		Output: state,
-	}, nil
+	return uploadOpts, nil
 }
 
 // Read retrieves the current state of the image
@@ -266,7 +508,7 @@ func (UploadedImage) Read(
 	}
 
 	// Create Hetzner Cloud client
-	hcloudClient := hcloud.NewClient(hcloud.WithToken(req.Inputs.HcloudToken))
+	hcloudClient := newHcloudClient(ctx, req.Inputs.HcloudToken)
 
 	// Get the image
 	image, _, err := hcloudClient.Image.GetByID(ctx, imageID)
@@ -281,14 +523,7 @@ func (UploadedImage) Read(
 
 	// Update state with current image information
 	state := req.State
-	state.ImageID = image.ID
-	state.ImageName = image.Name
-	state.Created = image.Created.String()
-	state.DiskSize = int(image.DiskSize)
-	state.OSFlavor = image.OSFlavor
-	state.OSVersion = image.OSVersion
-	state.Status = string(image.Status)
-	state.Type = string(image.Type)
+	state.setImage(image)
 
 	return infer.ReadResponse[UploadedImageArgs, UploadedImageState]{
 		ID:     req.ID,
@@ -300,14 +535,32 @@ func (UploadedImage) Read(
 // Delete removes the image from Hetzner Cloud.
 func (UploadedImage) Delete(ctx context.Context, req infer.DeleteRequest[UploadedImageState]) (infer.DeleteResponse, error) {
 	// Create Hetzner Cloud client
-	hcloudClient := hcloud.NewClient(hcloud.WithToken(req.State.HcloudToken))
+	hcloudClient := newHcloudClient(ctx, req.State.HcloudToken)
 
 	imageID, err := strconv.ParseInt(req.ID, 10, 64)
 	if err != nil {
 		return infer.DeleteResponse{}, fmt.Errorf("invalid image ID: %w", err)
 	}
 
-	image := &hcloud.Image{ID: imageID}
+	image, _, err := hcloudClient.Image.GetByID(ctx, imageID)
+	if err != nil {
+		return infer.DeleteResponse{}, fmt.Errorf("failed to get image: %w", err)
+	}
+	if image == nil {
+		return infer.DeleteResponse{}, nil // Image already deleted
+	}
+
+	// Snapshots that are reused by other resources are only released
+	if references(image) > 1 {
+		image, err = updateReferences(ctx, hcloudClient, image, -1)
+		if err != nil {
+			return infer.DeleteResponse{}, err
+		}
+		p.GetLogger(ctx).Infof("Snapshot %d is still referenced by %d resources, keeping it", image.ID, references(image))
+		audit(ctx, auditReleased, image.ID, req.State.UploadedImageArgs, req.State.SourceDigest)
+		return infer.DeleteResponse{}, nil
+	}
+
 	_, err = hcloudClient.Image.Delete(ctx, image)
 	if err != nil {
 		if hcloud.IsError(err, hcloud.ErrorCodeNotFound) {
@@ -315,6 +568,7 @@ func (UploadedImage) Delete(ctx context.Context, req infer.DeleteRequest[Uploade
 		}
 		return infer.DeleteResponse{}, fmt.Errorf("failed to delete image: %w", err)
 	}
+	audit(ctx, auditDeleted, image.ID, req.State.UploadedImageArgs, req.State.SourceDigest)
 
 	return infer.DeleteResponse{}, nil
 }
@@ -337,7 +591,7 @@ func (UploadedImage) Update(
 	}
 
 	// Create Hetzner Cloud client
-	hcloudClient := hcloud.NewClient(hcloud.WithToken(req.Inputs.HcloudToken))
+	hcloudClient := newHcloudClient(ctx, req.Inputs.HcloudToken)
 
 	// Update the image with new labels and description
 	updateOpts := hcloud.ImageUpdateOpts{}
@@ -346,26 +600,39 @@ func (UploadedImage) Update(
 		updateOpts.Description = req.Inputs.Description
 	}
 
+	current, _, err := hcloudClient.Image.GetByID(ctx, imageID)
+	if err != nil {
+		return infer.UpdateResponse[UploadedImageState]{}, fmt.Errorf("failed to get image: %w", err)
+	}
+	if current == nil {
+		return infer.UpdateResponse[UploadedImageState]{}, fmt.Errorf("%w: %d", ErrImageNotFound, imageID)
+	}
+
+	// The labels and description of a shared snapshot match the inputs of every resource that references it
+	labelsChanged := req.Inputs.Labels != nil && !mapsEqual(userLabels(current.Labels), req.Inputs.Labels)
+	descriptionChanged := req.Inputs.Description != nil && *req.Inputs.Description != current.Description
+	if references(current) > 1 && (labelsChanged || descriptionChanged) {
+		return infer.UpdateResponse[UploadedImageState]{}, fmt.Errorf(
+			"%w: snapshot %d is referenced by %d resources, replace the resource to change its labels or description",
+			ErrImageShared, imageID, references(current))
+	}
+
 	if req.Inputs.Labels != nil {
-		updateOpts.Labels = req.Inputs.Labels
+		// Keep the labels maintained by the provider, they are needed to reuse and release the snapshot
+		updateOpts.Labels = maps.Clone(req.Inputs.Labels)
+		maps.Copy(updateOpts.Labels, managedLabels(current.Labels))
 	}
 
 	image, _, err := hcloudClient.Image.Update(ctx, &hcloud.Image{ID: imageID}, updateOpts)
 	if err != nil {
 		return infer.UpdateResponse[UploadedImageState]{}, fmt.Errorf("failed to update image: %w", err)
 	}
+	audit(ctx, auditUpdated, image.ID, req.Inputs, req.State.SourceDigest)
 
 	// Update state
 	state := req.State
 	state.UploadedImageArgs = req.Inputs
-	state.ImageID = image.ID
-	state.ImageName = image.Name
-	state.Created = image.Created.String()
-	state.DiskSize = int(image.DiskSize)
-	state.OSFlavor = image.OSFlavor
-	state.OSVersion = image.OSVersion
-	state.Status = string(image.Status)
-	state.Type = string(image.Type)
+	state.setImage(image)
 
 	return infer.UpdateResponse[UploadedImageState]{
 		Output: state,
@@ -386,6 +653,9 @@ func (UploadedImage) Diff( //nolint:cyclop // TODO: refactor this function
 	if req.Inputs.Architecture != req.State.Architecture {
 		diff["architecture"] = p.PropertyDiff{Kind: p.UpdateReplace}
 	}
+	if stringPtrNotEqual(req.Inputs.ImageChecksum, req.State.ImageChecksum) {
+		diff["imageChecksum"] = p.PropertyDiff{Kind: p.UpdateReplace}
+	}
 
 	// Other properties can be updated in place
 	if req.Inputs.HcloudToken != req.State.HcloudToken {
@@ -416,6 +686,13 @@ func (UploadedImage) Diff( //nolint:cyclop // TODO: refactor this function
 		diff["description"] = p.PropertyDiff{Kind: p.Update}
 	}
 
+	if boolPtrNotEqual(req.Inputs.ReuseExisting, req.State.ReuseExisting) {
+		diff["reuseExisting"] = p.PropertyDiff{Kind: p.Update}
+	}
+	if boolPtrNotEqual(req.Inputs.KeepOnFailure, req.State.KeepOnFailure) {
+		diff["keepOnFailure"] = p.PropertyDiff{Kind: p.Update}
+	}
+
 	return infer.DiffResponse{
 		DeleteBeforeReplace: false,
 		HasChanges:          len(diff) > 0,
@@ -451,6 +728,16 @@ func stringPtrNotEqual(a, b *string) bool {
 	return *a != *b
 }
 
+func boolPtrNotEqual(a, b *bool) bool {
+	if a == nil && b == nil {
+		return false
+	}
+	if a == nil || b == nil {
+		return true
+	}
+	return *a != *b
+}
+
 // CleanupFunction provides a function to clean up any leftover resources
 type CleanupFunction struct{}
 
@@ -470,7 +757,7 @@ func (CleanupFunction) Invoke(
 	}
 
 	// Create Hetzner Cloud client
-	hcloudClient := hcloud.NewClient(hcloud.WithToken(req.Input.HcloudToken))
+	hcloudClient := newHcloudClient(ctx, req.Input.HcloudToken)
 	client := hcloudimages.NewClient(hcloudClient)
 
 	// Clean up temporary resources
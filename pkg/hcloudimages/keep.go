@@ -0,0 +1,226 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/exp/kit/sshutil"
+	p "github.com/pulumi/pulumi-go-provider"
+	"github.com/pulumi/pulumi-go-provider/infer"
+)
+
+const (
+	// KeptLabel marks the temporary server and debug SSH key of a failed upload that were kept for debugging, its
+	// value is the ID of the server. They are only removed by cleanupKeptResources, not by later runs of the same
+	// operation.
+	KeptLabel = managedLabelPrefix + "kept"
+
+	// privateKeyFileMode restricts the private key of a kept server to the current user
+	privateKeyFileMode = 0o600
+)
+
+// KeptResourcesError is returned when an upload failed and its temporary resources were kept for debugging
+type KeptResourcesError struct {
+	// OperationID identifies the kept resources, pass it to cleanupKeptResources to remove them
+	OperationID string
+	// ServerID is the ID of the temporary server
+	ServerID int64
+	// ServerIP is the public IPv4 address of the temporary server
+	ServerIP string
+	// PrivateKeyPath is the path of the private SSH key for the rescue system of the temporary server
+	PrivateKeyPath string
+
+	Err error
+}
+
+func (e *KeptResourcesError) Error() string {
+	return fmt.Sprintf("%s; temporary server %d was kept for debugging, connect with "+
+		"`ssh -i %s root@%s` and remove it with cleanupKeptResources(operationId: %q)",
+		e.Err, e.ServerID, e.PrivateKeyPath, e.ServerIP, e.OperationID)
+}
+
+func (e *KeptResourcesError) Unwrap() error { return e.Err }
+
+// privateKeyPath is where the private SSH key of a kept server is stored. Several runs of an operation can keep
+// a server each, so the path depends on the server.
+func privateKeyPath(dir string, serverID int64) string {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "hcloud-upload-image-"+strconv.FormatInt(serverID, 10)+".key")
+}
+
+// keepForDebugging makes the temporary server of a failed upload accessible. The upload library does not expose
+// its temporary SSH key, so the rescue system is enabled again with a new key that is written to keyDir, and the
+// server is restarted into it. The disk of the server keeps the partially written image. If the server cannot be
+// made accessible, the temporary resources are removed instead. serverID is the temporary server of this upload,
+// servers kept by earlier runs of the operation are left alone.
+func keepForDebugging(
+	ctx context.Context, client *hcloud.Client, opID string, serverID int64, keyDir string, uploadErr error,
+) error {
+	var server *hcloud.Server
+	if serverID != 0 {
+		var err error
+		server, _, err = client.Server.GetByID(ctx, serverID)
+		if err != nil {
+			return errors.Join(uploadErr, fmt.Errorf("failed to get temporary server %d, remove it with "+
+				"cleanupKeptResources(operationId: %q): %w", serverID, opID, err))
+		}
+	}
+	if server == nil {
+		// The upload failed before the server was created, only the SSH key might be left
+		return errors.Join(uploadErr, cleanupStaleResources(ctx, client, opID))
+	}
+
+	keyPath := privateKeyPath(keyDir, server.ID)
+	if err := enableDebugAccess(ctx, client, server, keyPath); err != nil {
+		p.GetLogger(ctx).Warningf("Failed to keep temporary server %d for debugging, removing it: %s", server.ID, err)
+		if removeErr := os.Remove(keyPath); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+			err = errors.Join(err, fmt.Errorf("failed to remove debug ssh key: %w", removeErr))
+		}
+		// The server might already be labelled as kept, servers kept by earlier runs have other IDs
+		cleanupErr := errors.Join(
+			cleanupResources(ctx, client, OperationLabel+"="+opID+","+KeptLabel+"="+keptLabelValue(server.ID)),
+			cleanupStaleResources(ctx, client, opID),
+		)
+		if cleanupErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to remove temporary resources, remove them with "+
+				"cleanupKeptResources(operationId: %q): %w", opID, cleanupErr))
+		}
+		return errors.Join(uploadErr, err)
+	}
+
+	return &KeptResourcesError{
+		OperationID:    opID,
+		ServerID:       server.ID,
+		ServerIP:       server.PublicNet.IPv4.IP.String(),
+		PrivateKeyPath: keyPath,
+		Err:            uploadErr,
+	}
+}
+
+// keptLabelValue is the value of KeptLabel on the resources of the kept server
+func keptLabelValue(serverID int64) string {
+	return strconv.FormatInt(serverID, 10)
+}
+
+// enableDebugAccess restarts the server into a rescue system that accepts a new SSH key, whose private key is
+// written to keyPath
+func enableDebugAccess(ctx context.Context, client *hcloud.Client, server *hcloud.Server, keyPath string) error {
+	privateKey, publicKey, err := sshutil.GenerateKeyPair()
+	if err != nil {
+		return fmt.Errorf("failed to generate debug ssh key pair: %w", err)
+	}
+	if err := os.WriteFile(keyPath, privateKey, privateKeyFileMode); err != nil {
+		return fmt.Errorf("failed to write debug ssh key: %w", err)
+	}
+
+	// Later runs of the operation leave the kept server alone, see cleanupStaleResources
+	labels := maps.Clone(server.Labels)
+	labels[KeptLabel] = keptLabelValue(server.ID)
+	if _, _, err := client.Server.Update(ctx, server, hcloud.ServerUpdateOpts{Labels: labels}); err != nil {
+		return fmt.Errorf("failed to label temporary server as kept: %w", err)
+	}
+
+	// The key has the labels of the server, so cleanupOperation removes it together with the server
+	key, _, err := client.SSHKey.Create(ctx, hcloud.SSHKeyCreateOpts{
+		Name:      server.Name + "-debug",
+		PublicKey: string(publicKey),
+		Labels:    labels,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create debug ssh key: %w", err)
+	}
+
+	rescue, _, err := client.Server.EnableRescue(ctx, server, hcloud.ServerEnableRescueOpts{
+		Type:    hcloud.ServerRescueTypeLinux64,
+		SSHKeys: []*hcloud.SSHKey{key},
+	})
+	if err == nil {
+		err = client.Action.WaitFor(ctx, rescue.Action)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to enable rescue system for debugging: %w", err)
+	}
+
+	var restart *hcloud.Action
+	if server.Status == hcloud.ServerStatusOff {
+		restart, _, err = client.Server.Poweron(ctx, server)
+	} else {
+		restart, _, err = client.Server.Reset(ctx, server)
+	}
+	if err == nil {
+		err = client.Action.WaitFor(ctx, restart)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restart temporary server for debugging: %w", err)
+	}
+	return nil
+}
+
+// CleanupKeptResources removes the temporary resources of an upload that were kept for debugging
+type CleanupKeptResources struct{}
+
+type CleanupKeptResourcesArgs struct {
+	HcloudToken string `pulumi:"hcloudToken" provider:"secret"`
+	OperationID string `pulumi:"operationId"`
+}
+
+func (args *CleanupKeptResourcesArgs) Annotate(a infer.Annotator) {
+	a.Describe(&args.HcloudToken, "The Hetzner Cloud API token.")
+	a.Describe(&args.OperationID, "The operation ID reported by the failed upload.")
+}
+
+type CleanupKeptResourcesResult struct {
+	Message string `pulumi:"message"`
+}
+
+func (result *CleanupKeptResourcesResult) Annotate(a infer.Annotator) {
+	a.Describe(&result.Message, "A message indicating the result of the cleanup operation.")
+}
+
+func (CleanupKeptResources) Invoke(
+	ctx context.Context, req infer.FunctionRequest[CleanupKeptResourcesArgs],
+) (infer.FunctionResponse[CleanupKeptResourcesResult], error) {
+	if req.Input.HcloudToken == "" {
+		return infer.FunctionResponse[CleanupKeptResourcesResult]{}, ErrHcloudTokenRequired
+	}
+	if req.Input.OperationID == "" {
+		return infer.FunctionResponse[CleanupKeptResourcesResult]{}, ErrOperationIDRequired
+	}
+
+	hcloudClient := newHcloudClient(ctx, req.Input.HcloudToken)
+	kept, err := hcloudClient.Server.AllWithOpts(ctx, hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: OperationLabel + "=" + req.Input.OperationID + "," + KeptLabel},
+	})
+	if err != nil {
+		return infer.FunctionResponse[CleanupKeptResourcesResult]{}, fmt.Errorf("failed to list kept servers: %w", err)
+	}
+	if err := cleanupOperation(ctx, hcloudClient, req.Input.OperationID); err != nil {
+		return infer.FunctionResponse[CleanupKeptResourcesResult]{}, fmt.Errorf("failed to cleanup kept resources: %w", err)
+	}
+
+	for _, server := range kept {
+		keyPath := privateKeyPath(infer.GetConfig[Config](ctx).debugKeyDirectory(), server.ID)
+		if err := os.Remove(keyPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			p.GetLogger(ctx).Warningf("Failed to remove debug ssh key %s: %s", keyPath, err)
+		}
+	}
+
+	return infer.FunctionResponse[CleanupKeptResourcesResult]{
+		Output: CleanupKeptResourcesResult{
+			Message: "Successfully cleaned up kept resources of operation " + req.Input.OperationID,
+		},
+	}, nil
+}
+
+func (r *CleanupKeptResources) Annotate(a infer.Annotator) {
+	a.Describe(r, "Removes the temporary server and SSH keys of a failed upload that were kept for debugging "+
+		"with keepOnFailure.")
+}
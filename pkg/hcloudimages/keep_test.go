@@ -0,0 +1,65 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+// A rerun with unchanged inputs has the same operation ID as the run that kept a server before
+func TestKeepForDebuggingKeepsServerOfThisUpload(t *testing.T) {
+	api, client := newFakeAPI(t)
+	api.addServer(1, map[string]string{OperationLabel: "op", KeptLabel: "1"})
+	api.addServer(2, map[string]string{OperationLabel: "op"})
+	keyDir := t.TempDir()
+	errUpload := errors.New("upload failed")
+
+	err := keepForDebugging(context.Background(), client, "op", 2, keyDir, errUpload)
+
+	var kept *KeptResourcesError
+	if !errors.As(err, &kept) || !errors.Is(err, errUpload) {
+		t.Fatalf("expected KeptResourcesError, got %v", err)
+	}
+	if kept.ServerID != 2 || kept.ServerIP != "203.0.113.2" || kept.OperationID != "op" {
+		t.Errorf("expected server 2 of operation op to be reported, got %+v", kept)
+	}
+	if kept.PrivateKeyPath != privateKeyPath(keyDir, 2) {
+		t.Errorf("expected the key at %s, got %s", privateKeyPath(keyDir, 2), kept.PrivateKeyPath)
+	}
+	if info, err := os.Stat(kept.PrivateKeyPath); err != nil || info.Mode().Perm() != privateKeyFileMode {
+		t.Errorf("expected the private key with mode %o, got %v (%v)", privateKeyFileMode, info, err)
+	}
+	if got := api.serverLabels(2)[KeptLabel]; got != "2" {
+		t.Errorf("expected server 2 to be labelled as kept, got %q", got)
+	}
+	if got := api.serverLabels(1)[KeptLabel]; got != "1" {
+		t.Errorf("expected the earlier kept server to stay labelled, got %q", got)
+	}
+}
+
+func TestKeepForDebuggingRemovesServerIfKeepingFails(t *testing.T) {
+	api, client := newFakeAPI(t)
+	api.addServer(1, map[string]string{OperationLabel: "op", KeptLabel: "1"})
+	api.addSSHKey(1, map[string]string{OperationLabel: "op", KeptLabel: "1"})
+	api.addServer(2, map[string]string{OperationLabel: "op"})
+	api.failActions = true
+	keyDir := t.TempDir()
+	errUpload := errors.New("upload failed")
+
+	err := keepForDebugging(context.Background(), client, "op", 2, keyDir, errUpload)
+
+	var kept *KeptResourcesError
+	if errors.As(err, &kept) || !errors.Is(err, errUpload) {
+		t.Fatalf("expected the upload error, got %v", err)
+	}
+	servers, keys := api.remaining()
+	if !slices.Equal(servers, []int64{1}) || !slices.Equal(keys, []int64{1}) {
+		t.Errorf("expected only the earlier kept resources to remain, servers %v and SSH keys %v remain",
+			servers, keys)
+	}
+	if _, err := os.Stat(privateKeyPath(keyDir, 2)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the private key to be removed, got %v", err)
+	}
+}
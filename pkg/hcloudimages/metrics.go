@@ -0,0 +1,64 @@
+package hcloudimages
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/pulumi/pulumi-go-provider/infer"
+)
+
+// contentLengthTimeout bounds the request for the size and ETag of the image
+const contentLengthTimeout = 30 * time.Second
+
+// uploadResult is the snapshot created by an upload together with the metrics of the upload
+type uploadResult struct {
+	image   *hcloud.Image
+	metrics uploadMetrics
+}
+
+// uploadMetrics describes how an upload went
+type uploadMetrics struct {
+	duration          time.Duration
+	reportedImageSize int64
+	serverType        string
+	location          string
+}
+
+// setMetrics copies the metrics of the upload into the state
+func (state *UploadedImageState) setMetrics(metrics uploadMetrics) {
+	state.UploadDurationSeconds = metrics.duration.Seconds()
+	state.ReportedImageSize = metrics.reportedImageSize
+	state.TemporaryServerType = metrics.serverType
+	state.TemporaryLocation = metrics.location
+}
+
+// contentLength returns the size of the image the temporary server downloads as reported by the image host.
+// The download does not pass through the provider, so it is not measured. It returns 0 if the size is unknown.
+func contentLength(ctx context.Context, imageURL string) int64 {
+	size, _ := headImage(ctx, imageURL)
+	return size
+}
+
+// headImage asks the image host for the size and the ETag of the image. They are 0 and "" if the host does
+// not report them, e.g. for pre-signed URLs that only allow GET requests.
+func headImage(ctx context.Context, imageURL string) (size int64, etag string) {
+	ctx, cancel := context.WithTimeout(ctx, contentLengthTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, imageURL, nil)
+	if err != nil {
+		return 0, ""
+	}
+	resp, err := infer.GetConfig[Config](ctx).imageHTTPClient().Do(req)
+	if err != nil {
+		return 0, ""
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, ""
+	}
+	return max(resp.ContentLength, 0), resp.Header.Get("ETag")
+}
@@ -0,0 +1,99 @@
+package hcloudimages
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	p "github.com/pulumi/pulumi-go-provider"
+)
+
+const (
+	notifyTimeout = 30 * time.Second
+
+	// SignatureHeader carries the HMAC-SHA256 of the webhook body, keyed with notifyWebhookSecret
+	SignatureHeader = "X-Hcloud-Upload-Image-Signature"
+)
+
+// uploadEvent is the payload of the generic webhook
+type uploadEvent struct {
+	Event           string  `json:"event"`
+	Name            string  `json:"name"`
+	URN             string  `json:"urn,omitempty"`
+	ImageID         int64   `json:"imageId,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// notifyCreate sends the result of Create to the configured webhooks. Failures to deliver are reported
+// as warnings, they do not change the result of Create.
+func notifyCreate(ctx context.Context, config Config, name string, start time.Time, imageID int64, createErr error) {
+	if config.NotifyWebhookURL == nil && config.NotifySlackWebhookURL == nil {
+		return
+	}
+
+	// The notification is also sent when Create was cancelled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout)
+	defer cancel()
+
+	urn, _ := ctx.Value(urnKey{}).(string)
+	event := uploadEvent{
+		Event:           "upload.succeeded",
+		Name:            name,
+		URN:             urn,
+		ImageID:         imageID,
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	if createErr != nil {
+		event.Event = "upload.failed"
+		event.ImageID = 0
+		event.Error = createErr.Error()
+	}
+
+	logger := p.GetLogger(ctx)
+	if config.NotifyWebhookURL != nil {
+		var secret string
+		if config.NotifyWebhookSecret != nil {
+			secret = *config.NotifyWebhookSecret
+		}
+		if err := postWebhook(ctx, config.imageHTTPClient(), *config.NotifyWebhookURL, event, secret); err != nil {
+			logger.Warningf("Failed to send webhook notification: %s", err)
+		}
+	}
+	if config.NotifySlackWebhookURL != nil {
+		message := map[string]string{"text": slackMessage(event)}
+		if err := postWebhook(ctx, config.imageHTTPClient(), *config.NotifySlackWebhookURL, message, ""); err != nil {
+			logger.Warningf("Failed to send Slack notification: %s", err)
+		}
+	}
+}
+
+// slackMessage summarizes the event for a chat channel
+func slackMessage(event uploadEvent) string {
+	duration := time.Duration(event.DurationSeconds * float64(time.Second)).Round(time.Second)
+	if event.Error != "" {
+		return fmt.Sprintf(":x: Upload of image `%s` failed after %s: %s", event.Name, duration, event.Error)
+	}
+	return fmt.Sprintf(":white_check_mark: Uploaded image `%s` as snapshot %d in %s", event.Name, event.ImageID, duration)
+}
+
+// postWebhook sends the payload as JSON. If secret is set, the body is signed in SignatureHeader.
+func postWebhook(ctx context.Context, client *http.Client, endpoint string, payload any, secret string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	header := http.Header{}
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return postJSON(ctx, client, endpoint, body, header)
+}
@@ -0,0 +1,135 @@
+package hcloudimages
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a request received by the test webhook server
+type webhookRequest struct {
+	path      string
+	signature string
+	body      []byte
+}
+
+func newWebhookServer(t *testing.T) (*httptest.Server, func() []webhookRequest) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []webhookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read webhook body: %s", err)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		mu.Lock()
+		requests = append(requests, webhookRequest{path: r.URL.Path, signature: r.Header.Get(SignatureHeader), body: body})
+		mu.Unlock()
+		if r.URL.Path == "/rejected" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func TestNotifyCreate(t *testing.T) {
+	server, received := newWebhookServer(t)
+	webhook, slack, secret := server.URL+"/webhook", server.URL+"/slack", "s3cret"
+	config := Config{NotifyWebhookURL: &webhook, NotifyWebhookSecret: &secret, NotifySlackWebhookURL: &slack}
+	ctx := context.WithValue(context.Background(), urnKey{}, "urn:pulumi:test::project::type::talos")
+	start := time.Now().Add(-2 * time.Minute)
+
+	notifyCreate(ctx, config, "talos", start, 42, nil)
+	notifyCreate(ctx, config, "talos", start, 0, errors.New("server creation failed"))
+
+	requests := received()
+	if len(requests) != 4 {
+		t.Fatalf("expected 4 notifications, got %d", len(requests))
+	}
+
+	for i, want := range []uploadEvent{
+		{Event: "upload.succeeded", Name: "talos", URN: "urn:pulumi:test::project::type::talos", ImageID: 42},
+		{Event: "upload.failed", Name: "talos", URN: "urn:pulumi:test::project::type::talos", Error: "server creation failed"},
+	} {
+		req := requests[2*i]
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(req.body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.path != "/webhook" || req.signature != want {
+			t.Errorf("expected a webhook request signed with %s, got %s signed with %q", want, req.path, req.signature)
+		}
+
+		var event uploadEvent
+		if err := json.Unmarshal(req.body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.DurationSeconds < 120 {
+			t.Errorf("expected a duration of at least 120s, got %f", event.DurationSeconds)
+		}
+		event.DurationSeconds = 0
+		if event != want {
+			t.Errorf("expected event %+v, got %+v", want, event)
+		}
+	}
+
+	for i, want := range []string{
+		":white_check_mark: Uploaded image `talos` as snapshot 42 in 2m0s",
+		":x: Upload of image `talos` failed after 2m0s: server creation failed",
+	} {
+		req := requests[2*i+1]
+		var message map[string]string
+		if err := json.Unmarshal(req.body, &message); err != nil {
+			t.Fatal(err)
+		}
+		if req.path != "/slack" || req.signature != "" || message["text"] != want {
+			t.Errorf("expected an unsigned Slack message %q, got %s %q signed with %q",
+				want, req.path, message["text"], req.signature)
+		}
+	}
+}
+
+func TestPostWebhookRejected(t *testing.T) {
+	server, _ := newWebhookServer(t)
+	err := postWebhook(context.Background(), server.Client(), server.URL+"/rejected", uploadEvent{}, "")
+	if !errors.Is(err, ErrRequestRejected) || !strings.Contains(err.Error(), "500") {
+		t.Errorf("expected the rejected request to fail, got %v", err)
+	}
+}
+
+// Webhook URLs contain their credentials, the delivery errors are logged and must not reveal them
+func TestPostWebhookErrorOmitsURL(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	for _, endpoint := range []string{
+		dead.URL + "/services/T000/B000/s3cret",
+		"http://user:s3cret@[::1/services/s3cret",
+	} {
+		err := postWebhook(context.Background(), http.DefaultClient, endpoint, uploadEvent{}, "")
+		if err == nil {
+			t.Fatalf("expected the delivery to %s to fail", endpoint)
+		}
+		if strings.Contains(err.Error(), "s3cret") {
+			t.Errorf("error reveals the webhook URL: %s", err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package hcloudimages
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	p "github.com/pulumi/pulumi-go-provider"
+)
+
+const (
+	// OperationLabel identifies all resources created by one upload of a resource.
+	// It is added to the temporary server, the temporary SSH key and the resulting snapshot.
+	OperationLabel = managedLabelPrefix + "operation"
+
+	// Label values are limited to 63 characters
+	operationIDLength = 32
+
+	snapshotPollInterval = 5 * time.Second
+)
+
+type urnKey struct{}
+
+// WithURN makes the URN of the resource available to [UploadedImage.Create], [UploadedImage.Update] and
+// [UploadedImage.Delete], which the infer layer does not pass on by itself.
+func WithURN(provider p.Provider) p.Provider {
+	create, update, del := provider.Create, provider.Update, provider.Delete
+	provider.Create = func(ctx context.Context, req p.CreateRequest) (p.CreateResponse, error) {
+		return create(context.WithValue(ctx, urnKey{}, string(req.Urn)), req)
+	}
+	provider.Update = func(ctx context.Context, req p.UpdateRequest) (p.UpdateResponse, error) {
+		return update(context.WithValue(ctx, urnKey{}, string(req.Urn)), req)
+	}
+	provider.Delete = func(ctx context.Context, req p.DeleteRequest) error {
+		return del(context.WithValue(ctx, urnKey{}, string(req.Urn)), req)
+	}
+	return provider
+}
+
+// operationID derives a stable ID for the upload from the resource URN and the inputs that affect the
+// resulting image. Repeating an interrupted `pulumi up` results in the same ID.
+func operationID(ctx context.Context, name string, inputs UploadedImageArgs) (string, error) {
+	urn, ok := ctx.Value(urnKey{}).(string)
+	if !ok || urn == "" {
+		urn = name
+	}
+
+	// The token does not affect the resulting image and may be rotated between runs
+	inputs.HcloudToken = ""
+	encodedInputs, err := json.Marshal(inputs)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash inputs: %w", err)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(urn))
+	hash.Write([]byte{0})
+	hash.Write(encodedInputs)
+	return hex.EncodeToString(hash.Sum(nil))[:operationIDLength], nil
+}
+
+// findOperationImage returns the snapshot created by a previous run of the same upload operation, or nil if
+// there is none. If the snapshot is still being created, it waits until it is available.
+func findOperationImage(ctx context.Context, client *hcloud.Client, opID string) (*hcloud.Image, error) {
+	images, err := client.Image.AllWithOpts(ctx, hcloud.ImageListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: OperationLabel + "=" + opID},
+		Type:     []hcloud.ImageType{hcloud.ImageTypeSnapshot},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+	if len(images) == 0 {
+		return nil, nil
+	}
+
+	image := images[0]
+	for image.Status == hcloud.ImageStatusCreating {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for snapshot %d: %w", image.ID, ctx.Err())
+		case <-time.After(snapshotPollInterval):
+		}
+
+		image, _, err = client.Image.GetByID(ctx, image.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get image: %w", err)
+		}
+		if image == nil {
+			return nil, nil
+		}
+	}
+
+	p.GetLogger(ctx).Infof("Adopting snapshot %d created by a previous interrupted run", image.ID)
+	return image, nil
+}
+
+// completeOperation removes the operation label from the snapshot once Create returns it. A later Create with
+// the same operation ID, e.g. a replacement with unchanged inputs, then uploads a new snapshot instead of adopting
+// one that is owned by another resource.
+func completeOperation(ctx context.Context, client *hcloud.Client, image *hcloud.Image) (*hcloud.Image, error) {
+	image, err := updateLabels(ctx, client, image, func(labels map[string]string) {
+		delete(labels, OperationLabel)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to complete upload operation: %w", err)
+	}
+	return image, nil
+}
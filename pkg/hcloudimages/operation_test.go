@@ -0,0 +1,68 @@
+package hcloudimages
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func TestExistingImageAdoptsInterruptedUpload(t *testing.T) {
+	api, client := newFakeAPI(t, snapshot(1, map[string]string{
+		OperationLabel:  "op",
+		ReferencesLabel: "1",
+	}))
+	// The interrupted run left its temporary server and SSH key, an earlier failed run kept its server
+	api.addServer(1, map[string]string{OperationLabel: "op"})
+	api.addSSHKey(1, map[string]string{OperationLabel: "op"})
+	api.addServer(2, map[string]string{OperationLabel: "op", KeptLabel: "true"})
+	api.addSSHKey(2, map[string]string{OperationLabel: "op", KeptLabel: "true"})
+	api.addServer(3, map[string]string{OperationLabel: "other"})
+
+	image, action, err := existingImage(context.Background(), client, "op", UploadedImageArgs{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image == nil || image.ID != 1 || action != auditAdopted {
+		t.Fatalf("expected snapshot 1 to be adopted, got %v (%s)", image, action)
+	}
+	if _, ok := api.image(1).Labels[OperationLabel]; ok {
+		t.Error("operation label was not removed from the adopted snapshot")
+	}
+	if references(image) != 1 {
+		t.Errorf("expected 1 reference, got %d", references(image))
+	}
+	servers, keys := api.remaining()
+	if !slices.Equal(servers, []int64{2, 3}) || !slices.Equal(keys, []int64{2}) {
+		t.Errorf("expected only the temporary resources of the interrupted run to be removed, "+
+			"servers %v and SSH keys %v remain", servers, keys)
+	}
+}
+
+// A replacement with unchanged inputs has the same operation ID as the resource it replaces. It must not adopt
+// the snapshot of that resource, otherwise deleting the replaced resource removes the snapshot of the new one.
+func TestReplaceDoesNotAdoptOwnedSnapshot(t *testing.T) {
+	api, client := newFakeAPI(t, snapshot(1, map[string]string{
+		OperationLabel:  "op",
+		ReferencesLabel: "1",
+	}))
+	ctx := context.Background()
+
+	// The first Create completes the operation of its snapshot
+	if _, err := completeOperation(ctx, client, &hcloud.Image{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replacement has the same operation ID and uploads a new snapshot
+	existing, _, err := existingImage(ctx, client, "op", UploadedImageArgs{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing != nil {
+		t.Fatalf("replacement adopted snapshot %d of the replaced resource", existing.ID)
+	}
+	if got := api.image(1).Labels[ReferencesLabel]; got != "1" {
+		t.Errorf("expected the snapshot of the replaced resource to keep 1 reference, got %s", got)
+	}
+}
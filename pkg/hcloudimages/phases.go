@@ -0,0 +1,359 @@
+package hcloudimages
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/contextlogger"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	p "github.com/pulumi/pulumi-go-provider"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// uploadPhase groups the steps of the upload library
+type uploadPhase string
+
+const (
+	phaseServerCreation uploadPhase = "server creation"
+	phaseRescueBoot     uploadPhase = "rescue boot"
+	phaseWrite          uploadPhase = "download/write"
+	phaseSnapshot       uploadPhase = "snapshot"
+)
+
+const (
+	actionPollInterval    = 10 * time.Second
+	maxActionPollInterval = time.Minute
+
+	// actionListPageSize is the maximum page size of the API, it keeps the requests per poll low
+	actionListPageSize = 50
+
+	// remoteOutputLines is the number of lines of remote command output attached to upload errors
+	remoteOutputLines = 20
+
+	// Progress of actions is logged in steps of this many percent, the status column shows every change
+	actionProgressLogStep = 10
+)
+
+// stepPhases maps the numbered steps logged by the upload library to the phases of an upload
+var stepPhases = map[int]uploadPhase{
+	1: phaseServerCreation, // Generating SSH Key
+	2: phaseServerCreation, // Creating Server
+	3: phaseRescueBoot,     // Activating Rescue System
+	4: phaseRescueBoot,     // Booting Server
+	5: phaseRescueBoot,     // Opening SSH Connection
+	6: phaseWrite,          // Cleaning existing disk
+	7: phaseWrite,          // Downloading image and writing to disk
+	8: phaseSnapshot,       // Shutting down server
+	9: phaseSnapshot,       // Creating Image
+}
+
+// phaseTracker follows the progress of an upload through the log records of the upload library. It reports the
+// progress to the Pulumi log and cancels the upload when a phase exceeds its timeout.
+type phaseTracker struct {
+	logger   p.Logger
+	client   *hcloud.Client
+	timeouts map[uploadPhase]time.Duration
+	cancel   context.CancelCauseFunc
+	done     chan struct{}
+
+	// spanCtx is the parent of the spans of the phases
+	spanCtx context.Context
+
+	mu         sync.Mutex
+	current    uploadPhase
+	span       trace.Span
+	timer      *time.Timer
+	serverID   int64
+	serverType string
+	location   string
+
+	// expectOutput is set when the next debug record of the upload library is the output of a remote command
+	expectOutput bool
+	output       []string
+}
+
+// phaseTrackerKey holds the tracker of an upload in the context, tracingTransport records the API requests of the
+// upload as children of the span of the current phase
+type phaseTrackerKey struct{}
+
+// trackPhases returns a context for [hcloudimages.Client.Upload] whose log records are followed by the tracker
+func trackPhases(
+	ctx context.Context, client *hcloud.Client, timeouts map[uploadPhase]time.Duration,
+) (context.Context, *phaseTracker) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	tracker := &phaseTracker{
+		logger:   p.GetLogger(ctx),
+		client:   client,
+		timeouts: timeouts,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		spanCtx:  ctx,
+	}
+	go tracker.pollActions(ctx)
+	ctx = context.WithValue(ctx, phaseTrackerKey{}, tracker)
+	return contextlogger.New(ctx, slog.New(&progressHandler{tracker: tracker})), tracker
+}
+
+// phase returns the phase the upload is currently in
+func (t *phaseTracker) phase() uploadPhase {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+// stop releases the resources of the tracker once the upload has returned
+func (t *phaseTracker) stop() {
+	t.mu.Lock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	if t.span != nil {
+		t.span.End()
+		t.span = nil
+	}
+	t.mu.Unlock()
+
+	t.cancel(nil)
+	<-t.done
+}
+
+func (t *phaseTracker) enter(phase uploadPhase) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if phase == t.current {
+		return
+	}
+	t.current = phase
+
+	if t.span != nil {
+		t.span.End()
+	}
+	_, t.span = tracer().Start(t.spanCtx, "upload phase "+string(phase), trace.WithAttributes(t.spanAttributes()...))
+
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	if timeout := t.timeouts[phase]; timeout > 0 {
+		t.timer = time.AfterFunc(timeout, func() {
+			t.cancel(fmt.Errorf("%w: %s phase exceeded %s", ErrPhaseTimeout, phase, timeout))
+		})
+	}
+}
+
+// phaseSpan returns the span of the current phase, or nil before the first and after the last phase
+func (t *phaseTracker) phaseSpan() trace.Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.span
+}
+
+func (t *phaseTracker) server() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.serverID
+}
+
+// temporaryServer returns the server type and location of the temporary server
+func (t *phaseTracker) temporaryServer() (serverType, location string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.serverType, t.location
+}
+
+func (t *phaseTracker) setAttr(attr slog.Attr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch attr.Key {
+	case "server":
+		if id, ok := attr.Value.Any().(int64); ok {
+			t.serverID = id
+		}
+	case "serverType":
+		t.serverType = attr.Value.String()
+	case "location":
+		t.location = attr.Value.String()
+	default:
+		return
+	}
+	if t.span != nil {
+		t.span.SetAttributes(t.spanAttributes()...)
+	}
+}
+
+// spanAttributes returns the attributes of the temporary server that are known so far
+func (t *phaseTracker) spanAttributes() []attribute.KeyValue {
+	attrs := []attribute.KeyValue{}
+	if t.serverType != "" {
+		attrs = append(attrs, serverTypeAttribute.String(t.serverType))
+	}
+	if t.location != "" {
+		attrs = append(attrs, locationAttribute.String(t.location))
+	}
+	return attrs
+}
+
+// remoteOutput returns the last lines of output of the commands run on the temporary server
+func (t *phaseTracker) remoteOutput() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.output)
+}
+
+// handleOutput recognizes the output of remote commands in the log records of the upload library. The library
+// logs the combined stdout and stderr of a command at debug level right after the step that ran it.
+func (t *phaseTracker) handleOutput(record slog.Record) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if record.Level >= slog.LevelInfo {
+		t.expectOutput = strings.HasPrefix(record.Message, "# Step 6:") ||
+			strings.HasPrefix(record.Message, "# Step 7: Finished")
+		return false
+	}
+	if !t.expectOutput {
+		return false
+	}
+	t.expectOutput = false
+
+	for line := range strings.Lines(record.Message) {
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		t.logger.Debug("remote: " + line)
+		t.output = append(t.output, line)
+	}
+	if len(t.output) > remoteOutputLines {
+		t.output = t.output[len(t.output)-remoteOutputLines:]
+	}
+	return true
+}
+
+// pollActions reports the progress of the running actions of the temporary server, the upload library
+// only logs once they are finished. Actions only run outside of the write phase, the poll interval grows
+// while a phase lasts to stay well below the rate limit of the API with many parallel uploads.
+func (t *phaseTracker) pollActions(ctx context.Context) {
+	defer close(t.done)
+
+	logged := map[int64]int{}
+	interval := actionPollInterval
+	polledPhase := uploadPhase("")
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		phase := t.phase()
+		if phase != polledPhase {
+			polledPhase = phase
+			interval = actionPollInterval
+		}
+		if serverID := t.server(); serverID != 0 && phase != phaseWrite {
+			t.reportActions(ctx, phase, serverID, logged)
+		}
+
+		timer.Reset(interval)
+		interval = min(2*interval, maxActionPollInterval)
+	}
+}
+
+// reportActions logs the progress of the running actions of the server, logged holds the progress last
+// written to the Pulumi log per action
+func (t *phaseTracker) reportActions(ctx context.Context, phase uploadPhase, serverID int64, logged map[int64]int) {
+	// The running actions of the whole project are listed, with many parallel uploads they span several pages
+	actions, err := t.client.Server.Action.All(ctx, hcloud.ActionListOpts{
+		ListOpts: hcloud.ListOpts{PerPage: actionListPageSize},
+		Status:   []hcloud.ActionStatus{hcloud.ActionStatusRunning},
+	})
+	if err != nil {
+		return
+	}
+
+	for _, action := range actions {
+		if !slices.ContainsFunc(action.Resources, func(r *hcloud.ActionResource) bool {
+			return r.Type == hcloud.ActionResourceTypeServer && r.ID == serverID
+		}) {
+			continue
+		}
+
+		message := fmt.Sprintf("%s: %s %d%%", phase, action.Command, action.Progress)
+		t.logger.InfoStatus(message)
+		if last, ok := logged[action.ID]; !ok || action.Progress >= last+actionProgressLogStep {
+			logged[action.ID] = action.Progress
+			t.logger.Info(message)
+		}
+	}
+}
+
+// progressHandler is a [slog.Handler] that passes the log records of the upload library to the tracker
+type progressHandler struct {
+	tracker *phaseTracker
+	attrs   []slog.Attr
+}
+
+func (h *progressHandler) Enabled(_ context.Context, _ slog.Level) bool { return true }
+
+func (h *progressHandler) Handle(_ context.Context, record slog.Record) error {
+	// The upload library logs the temporary server it creates as attributes
+	record.Attrs(func(attr slog.Attr) bool {
+		h.tracker.setAttr(attr)
+		return true
+	})
+
+	var step int
+	if _, err := fmt.Sscanf(record.Message, "# Step %d:", &step); err == nil {
+		if phase, ok := stepPhases[step]; ok {
+			h.tracker.enter(phase)
+		}
+	}
+
+	if h.tracker.handleOutput(record) {
+		return nil
+	}
+
+	message := strings.TrimPrefix(record.Message, "# ")
+	switch {
+	case record.Level >= slog.LevelWarn:
+		h.tracker.logger.Warning(formatRecord(message, h.attrs, record))
+	case record.Level >= slog.LevelInfo:
+		h.tracker.logger.Info(message)
+		h.tracker.logger.InfoStatus(message)
+	default:
+		h.tracker.logger.Debug(formatRecord(message, h.attrs, record))
+	}
+	return nil
+}
+
+func (h *progressHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for _, attr := range attrs {
+		h.tracker.setAttr(attr)
+	}
+	return &progressHandler{tracker: h.tracker, attrs: append(slices.Clone(h.attrs), attrs...)}
+}
+
+func (h *progressHandler) WithGroup(_ string) slog.Handler { return h }
+
+// formatRecord appends the attributes of the handler and the record to the message
+func formatRecord(message string, attrs []slog.Attr, record slog.Record) string {
+	var b strings.Builder
+	b.WriteString(message)
+	for _, attr := range attrs {
+		fmt.Fprintf(&b, " %s=%s", attr.Key, attr.Value)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%s", attr.Key, attr.Value)
+		return true
+	})
+	return b.String()
+}
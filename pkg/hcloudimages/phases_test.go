@@ -0,0 +1,64 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/contextlogger"
+)
+
+// The records follow the log output of hcloudimages.Client.Upload
+func TestProgressHandlerTracksPhases(t *testing.T) {
+	_, client := newFakeAPI(t)
+	ctx, tracker := trackPhases(context.Background(), client, map[uploadPhase]time.Duration{
+		phaseWrite: 50 * time.Millisecond,
+	})
+	defer tracker.stop()
+	logger := contextlogger.From(ctx)
+
+	for _, step := range []struct {
+		message string
+		phase   uploadPhase
+	}{
+		{"# Step 1: Generating SSH Key", phaseServerCreation},
+		{"# Step 2: Creating Server", phaseServerCreation},
+		{"# Step 3: Activating Rescue System", phaseRescueBoot},
+		{"# Step 5: Opening SSH Connection", phaseRescueBoot},
+		{"# Step 6: Cleaning existing disk", phaseWrite},
+	} {
+		logger.InfoContext(ctx, step.message)
+		if got := tracker.phase(); got != step.phase {
+			t.Errorf("%q: expected phase %q, got %q", step.message, step.phase, got)
+		}
+	}
+
+	logger.With("server", int64(42)).DebugContext(ctx, "wipefs output\n")
+	if got := tracker.server(); got != 42 {
+		t.Errorf("expected server 42, got %d", got)
+	}
+	if got := tracker.remoteOutput(); !slices.Equal(got, []string{"wipefs output"}) {
+		t.Errorf("expected the remote output to be recorded, got %q", got)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("upload was not cancelled after the write timeout")
+	}
+	cause := context.Cause(ctx)
+	if !errors.Is(cause, ErrPhaseTimeout) || !strings.Contains(cause.Error(), string(phaseWrite)) {
+		t.Errorf("expected a write phase timeout, got %v", cause)
+	}
+}
+
+func TestConfigureRejectsNegativeTimeout(t *testing.T) {
+	timeout := "-5m"
+	config := Config{WriteTimeout: &timeout}
+	if err := config.Configure(context.Background()); !errors.Is(err, ErrInvalidTimeout) {
+		t.Errorf("expected ErrInvalidTimeout, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package hcloudimages
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// Every upload creates one temporary server with a primary IPv4 and IPv6 and results in one snapshot
+	uploadServers    = 1
+	uploadPrimaryIPs = 2
+	uploadSnapshots  = 1
+)
+
+// checkQuota verifies that the project has room for the temporary server, its primary IPs and the
+// resulting snapshot. The Hetzner Cloud API does not expose the project limits, so they are taken
+// from the provider configuration and only the configured ones are checked.
+func checkQuota(ctx context.Context, client *hcloud.Client, cfg Config) error {
+	if cfg.ServerLimit != nil {
+		servers, err := client.Server.All(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list servers: %w", err)
+		}
+		if len(servers)+uploadServers > *cfg.ServerLimit {
+			return fmt.Errorf("%w: %d of %d servers in use, the upload needs %d more",
+				ErrQuotaExceeded, len(servers), *cfg.ServerLimit, uploadServers)
+		}
+	}
+
+	if cfg.PrimaryIPLimit != nil {
+		primaryIPs, err := client.PrimaryIP.All(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list primary IPs: %w", err)
+		}
+		if len(primaryIPs)+uploadPrimaryIPs > *cfg.PrimaryIPLimit {
+			return fmt.Errorf("%w: %d of %d primary IPs in use, the upload needs %d more",
+				ErrQuotaExceeded, len(primaryIPs), *cfg.PrimaryIPLimit, uploadPrimaryIPs)
+		}
+	}
+
+	if cfg.SnapshotLimit != nil {
+		snapshots, err := client.Image.AllWithOpts(ctx, hcloud.ImageListOpts{
+			Type: []hcloud.ImageType{hcloud.ImageTypeSnapshot},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots: %w", err)
+		}
+		if len(snapshots)+uploadSnapshots > *cfg.SnapshotLimit {
+			return fmt.Errorf("%w: %d of %d snapshots in use, the upload needs %d more",
+				ErrQuotaExceeded, len(snapshots), *cfg.SnapshotLimit, uploadSnapshots)
+		}
+	}
+
+	return nil
+}
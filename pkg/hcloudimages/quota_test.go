@@ -0,0 +1,47 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+)
+
+func TestCheckQuota(t *testing.T) {
+	system := schema.Image{ID: 3, Type: string(hcloud.ImageTypeSystem), Status: string(hcloud.ImageStatusAvailable)}
+	api, client := newFakeAPI(t, snapshot(1, nil), snapshot(2, nil), system)
+	api.addServer(1, nil)
+	api.addPrimaryIPs(2)
+	ctx := context.Background()
+
+	if err := checkQuota(ctx, client, Config{}); err != nil {
+		t.Errorf("expected no check without limits, got %v", err)
+	}
+
+	limit := func(n int) *int { return &n }
+	for _, tc := range []struct {
+		name   string
+		config Config
+		err    string
+	}{
+		{"servers", Config{ServerLimit: limit(1)}, "1 of 1 servers in use"},
+		{"primary IPs", Config{PrimaryIPLimit: limit(3)}, "2 of 3 primary IPs in use, the upload needs 2 more"},
+		{"snapshots", Config{SnapshotLimit: limit(2)}, "2 of 2 snapshots in use"},
+		{"servers with room", Config{ServerLimit: limit(2)}, ""},
+		{"primary IPs with room", Config{PrimaryIPLimit: limit(4)}, ""},
+		{"snapshots with room", Config{SnapshotLimit: limit(3)}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkQuota(ctx, client, tc.config)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("expected the upload to fit, got %v", err)
+			case tc.err != "" && (!errors.Is(err, ErrQuotaExceeded) || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("expected ErrQuotaExceeded with %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package hcloudimages
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	p "github.com/pulumi/pulumi-go-provider"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages"
+)
+
+const (
+	// managedLabelPrefix is shared by all labels the provider maintains on its snapshots
+	managedLabelPrefix = "hcloud-upload-image.exivity.com/"
+
+	// SourceDigestLabel, ArchitectureLabel and FormatLabel describe where a snapshot came from.
+	// They are used to find identical snapshots when reuseExisting is enabled.
+	SourceDigestLabel = managedLabelPrefix + "source-digest"
+	ArchitectureLabel = managedLabelPrefix + "architecture"
+	FormatLabel       = managedLabelPrefix + "format"
+
+	// ReferencesLabel counts the resources that use a snapshot. Delete only removes the snapshot
+	// once the last resource releases it.
+	ReferencesLabel = managedLabelPrefix + "references"
+
+	sourceDigestLength = 32
+)
+
+// sourceDigest identifies the image source by its URL, compression and content. The content is identified by the
+// imageChecksum input, or else by the validators the image host reported, see sourceValidators.
+func sourceDigest(inputs UploadedImageArgs, validators string) string {
+	hash := sha256.New()
+	if inputs.ImageURL != nil {
+		hash.Write([]byte(*inputs.ImageURL))
+	}
+	hash.Write([]byte{0})
+	if inputs.ImageCompression != nil {
+		hash.Write([]byte(*inputs.ImageCompression))
+	}
+	hash.Write([]byte{0})
+	hash.Write([]byte(validators))
+	return hex.EncodeToString(hash.Sum(nil))[:sourceDigestLength]
+}
+
+// sourceValidators returns the imageChecksum input, or else the ETag and size of the image reported by the
+// image host. It returns "" if neither is known, the digest then only covers the URL.
+func sourceValidators(ctx context.Context, inputs UploadedImageArgs) string {
+	if inputs.ImageChecksum != nil && *inputs.ImageChecksum != "" {
+		return "checksum=" + *inputs.ImageChecksum
+	}
+	if inputs.ImageURL == nil {
+		return ""
+	}
+	size, etag := headImage(ctx, *inputs.ImageURL)
+	if size == 0 && etag == "" {
+		return ""
+	}
+	return fmt.Sprintf("etag=%s,size=%d", etag, size)
+}
+
+// provenanceLabels returns the labels that describe the source of the snapshot
+func provenanceLabels(inputs UploadedImageArgs, digest string) map[string]string {
+	format := "raw"
+	if inputs.ImageFormat != nil && *inputs.ImageFormat != "" {
+		format = *inputs.ImageFormat
+	}
+
+	return map[string]string{
+		SourceDigestLabel: digest,
+		ArchitectureLabel: inputs.Architecture,
+		FormatLabel:       format,
+	}
+}
+
+// managedLabels returns the labels of the image that are maintained by the provider
+func managedLabels(labels map[string]string) map[string]string {
+	managed := map[string]string{}
+	for k, v := range labels {
+		if strings.HasPrefix(k, managedLabelPrefix) {
+			managed[k] = v
+		}
+	}
+	return managed
+}
+
+// userLabels returns the labels of the image that were set by the user
+func userLabels(labels map[string]string) map[string]string {
+	user := map[string]string{}
+	for k, v := range labels {
+		if _, ok := hcloudimages.DefaultLabels[k]; !ok && !strings.HasPrefix(k, managedLabelPrefix) {
+			user[k] = v
+		}
+	}
+	return user
+}
+
+// references returns the number of resources that use the image
+func references(image *hcloud.Image) int {
+	count, err := strconv.Atoi(image.Labels[ReferencesLabel])
+	if err != nil || count < 1 {
+		return 1
+	}
+	return count
+}
+
+// labelsMu serializes label updates of snapshots in this provider process
+var labelsMu sync.Mutex
+
+// updateLabels changes the labels of the image with update
+func updateLabels(
+	ctx context.Context, client *hcloud.Client, image *hcloud.Image, update func(labels map[string]string),
+) (*hcloud.Image, error) {
+	labelsMu.Lock()
+	defer labelsMu.Unlock()
+
+	// Start from the current labels, the passed image might be outdated
+	current, _, err := client.Image.GetByID(ctx, image.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image: %w", err)
+	}
+	if current == nil {
+		return nil, fmt.Errorf("%w: %d", ErrImageNotFound, image.ID)
+	}
+
+	labels := maps.Clone(current.Labels)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	update(labels)
+
+	updated, _, err := client.Image.Update(ctx, current, hcloud.ImageUpdateOpts{Labels: labels})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update image labels: %w", err)
+	}
+	return updated, nil
+}
+
+// updateReferences adds delta to the reference count of the image
+func updateReferences(ctx context.Context, client *hcloud.Client, image *hcloud.Image, delta int) (*hcloud.Image, error) {
+	return updateLabels(ctx, client, image, func(labels map[string]string) {
+		labels[ReferencesLabel] = strconv.Itoa(references(&hcloud.Image{Labels: labels}) + delta)
+	})
+}
+
+// reuseImage looks for an available snapshot with the same provenance, labels and description and takes a
+// reference on it. It returns nil if there is no such snapshot. Requiring the same labels and description
+// keeps the snapshot matching the inputs of every resource that references it.
+func reuseImage(
+	ctx context.Context, client *hcloud.Client, inputs UploadedImageArgs, digest string,
+) (*hcloud.Image, error) {
+	provenance := provenanceLabels(inputs, digest)
+	selector := make([]string, 0, len(provenance))
+	for k, v := range provenance {
+		selector = append(selector, k+"="+v)
+	}
+
+	images, err := client.Image.AllWithOpts(ctx, hcloud.ImageListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: strings.Join(selector, ",")},
+		Type:     []hcloud.ImageType{hcloud.ImageTypeSnapshot},
+		Status:   []hcloud.ImageStatus{hcloud.ImageStatusAvailable},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	for _, candidate := range images {
+		if !mapsEqual(userLabels(candidate.Labels), inputs.Labels) ||
+			(inputs.Description != nil && *inputs.Description != candidate.Description) {
+			continue
+		}
+
+		image, err := updateReferences(ctx, client, candidate, 1)
+		if err != nil {
+			return nil, err
+		}
+		p.GetLogger(ctx).Infof("Reusing existing snapshot %d, now referenced by %d resources", image.ID, references(image))
+		return image, nil
+	}
+	return nil, nil
+}
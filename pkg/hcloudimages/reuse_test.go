@@ -0,0 +1,64 @@
+package hcloudimages
+
+import (
+	"context"
+	"maps"
+	"testing"
+)
+
+func TestSourceDigestCoversContent(t *testing.T) {
+	url := "https://example.com/latest.raw.xz"
+	inputs := UploadedImageArgs{ImageURL: &url}
+
+	if sourceDigest(inputs, "etag=a,size=1") == sourceDigest(inputs, "etag=b,size=1") {
+		t.Error("digest does not change with the image content")
+	}
+	if sourceDigest(inputs, "etag=a,size=1") != sourceDigest(inputs, "etag=a,size=1") {
+		t.Error("digest is not stable")
+	}
+
+	checksum := "sha256:abc"
+	inputs.ImageChecksum = &checksum
+	if got := sourceValidators(context.Background(), inputs); got != "checksum=sha256:abc" {
+		t.Errorf("expected the checksum to identify the content, got %q", got)
+	}
+}
+
+func TestReuseImageRequiresSameLabelsAndDescription(t *testing.T) {
+	inputs := UploadedImageArgs{Architecture: "x86", Labels: map[string]string{"env": "prod"}}
+	provenance := provenanceLabels(inputs, "digest")
+	withLabels := func(extra map[string]string) map[string]string {
+		labels := map[string]string{ReferencesLabel: "1", "apricote.de/created-by": "hcloud-upload-image"}
+		maps.Copy(labels, provenance)
+		maps.Copy(labels, extra)
+		return labels
+	}
+	other := snapshot(1, withLabels(map[string]string{"env": "dev"}))
+	matching := snapshot(2, withLabels(map[string]string{"env": "prod"}))
+	api, client := newFakeAPI(t, other, matching)
+	ctx := context.Background()
+
+	image, err := reuseImage(ctx, client, inputs, "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image == nil || image.ID != 2 {
+		t.Fatalf("expected snapshot 2 with the same labels to be reused, got %v", image)
+	}
+	if got := api.image(2).Labels[ReferencesLabel]; got != "2" {
+		t.Errorf("expected 2 references, got %s", got)
+	}
+	if got := api.image(1).Labels[ReferencesLabel]; got != "1" {
+		t.Errorf("snapshot with other labels was referenced, it has %s references", got)
+	}
+
+	description := "other"
+	inputs.Description = &description
+	image, err = reuseImage(ctx, client, inputs, "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image != nil {
+		t.Errorf("snapshot %d with a different description was reused", image.ID)
+	}
+}
@@ -0,0 +1,155 @@
+package hcloudimages
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	p "github.com/pulumi/pulumi-go-provider"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span attributes of the provider
+const (
+	urnAttribute        = attribute.Key("pulumi.urn")
+	imageIDAttribute    = attribute.Key("hcloud.image.id")
+	serverTypeAttribute = attribute.Key("hcloud.server_type")
+	locationAttribute   = attribute.Key("hcloud.location")
+)
+
+// tracerName identifies the spans of the provider
+const tracerName = "github.com/exivity/pulumi-hcloud-upload-image/pkg/hcloudimages"
+
+// tracer returns the tracer of the current global tracer provider, which is a no-op unless SetupTracing installed
+// an exporter
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// SetupTracing exports traces with OTLP over HTTP when the standard OTEL_* environment variables configure
+// an endpoint. The returned function flushes the remaining spans and must be called before the provider exits.
+func SetupTracing(ctx context.Context) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	if !tracingEnabled() {
+		return noop, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return noop, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+	// Attributes from OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence over the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", applicationName),
+			attribute.String("service.version", Version),
+		),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return noop, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// tracingEnabled reports whether the environment configures an OTLP endpoint for traces
+func tracingEnabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	if exporter := os.Getenv("OTEL_TRACES_EXPORTER"); exporter != "" && exporter != "otlp" {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// WithTracing records a span for each Create, Read, Update and Delete of a resource
+func WithTracing(provider p.Provider) p.Provider {
+	create, read, update, del := provider.Create, provider.Read, provider.Update, provider.Delete
+
+	provider.Create = func(ctx context.Context, req p.CreateRequest) (p.CreateResponse, error) {
+		ctx, span := tracer().Start(ctx, "Create", trace.WithAttributes(urnAttribute.String(string(req.Urn))))
+		resp, err := create(ctx, req)
+		if !req.DryRun && resp.ID != "" {
+			span.SetAttributes(imageIDAttribute.String(resp.ID))
+		}
+		endSpan(span, err)
+		return resp, err
+	}
+	provider.Read = func(ctx context.Context, req p.ReadRequest) (p.ReadResponse, error) {
+		ctx, span := startResourceSpan(ctx, "Read", string(req.Urn), req.ID)
+		resp, err := read(ctx, req)
+		endSpan(span, err)
+		return resp, err
+	}
+	provider.Update = func(ctx context.Context, req p.UpdateRequest) (p.UpdateResponse, error) {
+		ctx, span := startResourceSpan(ctx, "Update", string(req.Urn), req.ID)
+		resp, err := update(ctx, req)
+		endSpan(span, err)
+		return resp, err
+	}
+	provider.Delete = func(ctx context.Context, req p.DeleteRequest) error {
+		ctx, span := startResourceSpan(ctx, "Delete", string(req.Urn), req.ID)
+		err := del(ctx, req)
+		endSpan(span, err)
+		return err
+	}
+	return provider
+}
+
+func startResourceSpan(ctx context.Context, name, urn, id string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(urnAttribute.String(urn), imageIDAttribute.String(id)))
+}
+
+// endSpan marks the span as failed if err is set and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingTransport records a span for each request to the Hetzner Cloud API. Requests of an upload are recorded
+// in the span of the phase they happen in.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent := req.Context()
+	if tracker, ok := parent.Value(phaseTrackerKey{}).(*phaseTracker); ok {
+		if span := tracker.phaseSpan(); span != nil {
+			parent = trace.ContextWithSpan(parent, span)
+		}
+	}
+
+	ctx, span := tracer().Start(parent, "hcloud "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= http.StatusBadRequest {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	endSpan(span, err)
+	return resp, err
+}
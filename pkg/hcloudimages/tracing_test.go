@@ -0,0 +1,181 @@
+package hcloudimages
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/contextlogger"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	p "github.com/pulumi/pulumi-go-provider"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestWithTracingRecordsPhasesAndAPICalls(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	setTracerProvider(t, provider)
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+
+	api, _ := newFakeAPI(t, snapshot(1, nil))
+	client := hcloud.NewClient(
+		hcloud.WithToken("token"),
+		hcloud.WithEndpoint(api.url),
+		hcloud.WithHTTPClient(&http.Client{Transport: tracingTransport{base: http.DefaultTransport}}),
+	)
+
+	// Create follows the log records and API calls of an upload
+	traced := WithTracing(p.Provider{
+		Create: func(ctx context.Context, _ p.CreateRequest) (p.CreateResponse, error) {
+			uploadCtx, phases := trackPhases(ctx, client, nil)
+			defer phases.stop()
+			logger := contextlogger.From(uploadCtx)
+
+			logger.InfoContext(uploadCtx, "# Step 2: Creating Server")
+			logger.DebugContext(uploadCtx, "creating server with config", "location", "fsn1", "serverType", "cx22")
+			if _, _, err := client.Image.GetByID(uploadCtx, 1); err != nil {
+				return p.CreateResponse{}, err
+			}
+			logger.InfoContext(uploadCtx, "# Step 9: Creating Image")
+			if _, _, err := client.Image.GetByID(uploadCtx, 1); err != nil {
+				return p.CreateResponse{}, err
+			}
+			return p.CreateResponse{ID: "1"}, nil
+		},
+	})
+	const urn = "urn:pulumi:test::project::hcloud-upload-image:hcloudimages:UploadedImage::talos"
+	if _, err := traced.Create(context.Background(), p.CreateRequest{Urn: urn}); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	children := map[string][]string{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+		for _, parent := range exporter.GetSpans() {
+			if parent.SpanContext.SpanID() == span.Parent.SpanID() {
+				children[parent.Name] = append(children[parent.Name], span.Name)
+			}
+		}
+	}
+
+	create, ok := spans["Create"]
+	if !ok {
+		t.Fatalf("no Create span, got %v", exporter.GetSpans().Snapshots())
+	}
+	expectAttributes(t, create, urnAttribute.String(urn), imageIDAttribute.String("1"))
+	expectAttributes(t, spans["upload phase server creation"],
+		serverTypeAttribute.String("cx22"), locationAttribute.String("fsn1"))
+	expectAttributes(t, spans["upload phase snapshot"],
+		serverTypeAttribute.String("cx22"), locationAttribute.String("fsn1"))
+
+	for parent, want := range map[string][]string{
+		"Create":                       {"upload phase server creation", "upload phase snapshot"},
+		"upload phase server creation": {"hcloud GET"},
+		"upload phase snapshot":        {"hcloud GET"},
+	} {
+		if got := children[parent]; !equalUnordered(got, want) {
+			t.Errorf("expected %q to have the children %q, got %q", parent, want, got)
+		}
+	}
+}
+
+func expectAttributes(t *testing.T, span tracetest.SpanStub, want ...attribute.KeyValue) {
+	t.Helper()
+	for _, attr := range want {
+		found := false
+		for _, actual := range span.Attributes {
+			found = found || actual == attr
+		}
+		if !found {
+			t.Errorf("span %q lacks the attribute %s=%s, got %v", span.Name, attr.Key, attr.Value.Emit(), span.Attributes)
+		}
+	}
+}
+
+func equalUnordered(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := map[string]int{}
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		counts[s]--
+		if counts[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The spans reach an OTLP/HTTP collector configured with the standard environment variables
+func TestSetupTracingExportsToCollector(t *testing.T) {
+	var mu sync.Mutex
+	var exports [][]byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected export to %s (%s): %v", r.URL.Path, r.Header.Get("Content-Type"), err)
+		}
+		mu.Lock()
+		exports = append(exports, body)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	t.Cleanup(collector.Close)
+
+	t.Setenv("OTEL_SDK_DISABLED", "")
+	t.Setenv("OTEL_TRACES_EXPORTER", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_SERVICE_NAME", "test-provider")
+	setTracerProvider(t, otel.GetTracerProvider())
+
+	shutdown, err := SetupTracing(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	traced := WithTracing(p.Provider{
+		Create: func(context.Context, p.CreateRequest) (p.CreateResponse, error) {
+			return p.CreateResponse{ID: "1"}, nil
+		},
+	})
+	const urn = "urn:pulumi:test::project::hcloud-upload-image:hcloudimages:UploadedImage::talos"
+	if _, err := traced.Create(context.Background(), p.CreateRequest{Urn: urn}); err != nil {
+		t.Fatal(err)
+	}
+	// Shutting down flushes the batched spans
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(exports) == 0 {
+		t.Fatal("the collector received no spans")
+	}
+	// The export is protobuf encoded, its strings appear verbatim in the body
+	export := bytes.Join(exports, nil)
+	for _, want := range []string{"test-provider", "Create", string(urnAttribute), urn} {
+		if !bytes.Contains(export, []byte(want)) {
+			t.Errorf("the exported spans lack %q", want)
+		}
+	}
+}
+
+// setTracerProvider installs the tracer provider for the test and restores the previous one afterwards
+func setTracerProvider(t *testing.T, provider trace.TracerProvider) {
+	t.Helper()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+}
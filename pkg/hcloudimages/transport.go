@@ -0,0 +1,201 @@
+package hcloudimages
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	p "github.com/pulumi/pulumi-go-provider"
+	"github.com/pulumi/pulumi-go-provider/infer"
+)
+
+// applicationName identifies the provider in the user agent of its requests to the Hetzner Cloud API
+const applicationName = "pulumi-hcloud-upload-image"
+
+// Version is the provider version reported in the user agent, it is set by main
+var Version = "dev"
+
+// newHcloudClient returns a Hetzner Cloud client that uses the network, debug and user agent settings of the
+// provider configuration and traces its requests
+func newHcloudClient(ctx context.Context, token string) *hcloud.Client {
+	config := infer.GetConfig[Config](ctx)
+	opts := []hcloud.ClientOption{
+		hcloud.WithToken(token),
+		hcloud.WithApplication(applicationName, config.applicationVersion()),
+	}
+	transport := config.imageHTTPClient().Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	opts = append(opts, hcloud.WithHTTPClient(&http.Client{Transport: tracingTransport{base: transport}}))
+	if config.DebugAPILogging != nil && *config.DebugAPILogging {
+		opts = append(opts, hcloud.WithDebugWriter(apiDebugWriter{logger: p.GetLogger(ctx), secrets: []string{token}}))
+	}
+	return hcloud.NewClient(opts...)
+}
+
+// applicationVersion returns the version for the user agent, followed by the user agent suffix as a comment
+func (c Config) applicationVersion() string {
+	if c.UserAgentSuffix == nil || *c.UserAgentSuffix == "" {
+		return Version
+	}
+	return Version + " (" + *c.UserAgentSuffix + ")"
+}
+
+// imageHTTPClient returns the HTTP client for requests of the provider to image hosts
+func (c Config) imageHTTPClient() *http.Client {
+	if c.httpClient == nil {
+		return http.DefaultClient
+	}
+	return c.httpClient
+}
+
+// newHTTPClient returns an HTTP client with the configured proxy and CA bundle. It returns nil if none of them
+// is configured, the default clients then use the proxy environment variables and the system CAs.
+func (c Config) newHTTPClient() (*http.Client, error) {
+	if c.HTTPProxy == nil && c.NoProxy == nil && c.CABundleFile == nil {
+		return nil, nil
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		transport = &http.Transport{}
+	}
+	transport = transport.Clone()
+
+	proxy, err := c.proxy()
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = proxy
+
+	if c.CABundleFile != nil {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		bundle, err := os.ReadFile(*c.CABundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCABundle, *c.CABundleFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// proxy returns the proxy for a request. It is httpProxy, or else the proxy of the environment variables, unless
+// noProxy matches the host of the request.
+func (c Config) proxy() (func(*http.Request) (*url.URL, error), error) {
+	proxy := http.ProxyFromEnvironment
+	if c.HTTPProxy != nil {
+		// The errors leave out the URL, it can contain the password of the proxy. Redacting it is not enough,
+		// without a scheme 'user:password@host' parses as an opaque URL whose password is not redacted.
+		proxyURL, err := url.Parse(*c.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("%w: not a valid URL", ErrInvalidHTTPProxy)
+		}
+		if proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("%w: must be an absolute URL like 'http://proxy:3128'", ErrInvalidHTTPProxy)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	if c.NoProxy == nil {
+		return proxy, nil
+	}
+
+	noProxy := strings.Split(*c.NoProxy, ",")
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return proxy(req)
+	}, nil
+}
+
+// bypassProxy reports whether requests to u go around the proxy. The entries follow the NO_PROXY
+// conventions: '*' matches all hosts, IP ranges are given in CIDR notation, and a domain matches
+// itself and its subdomains, optionally limited to a port.
+func bypassProxy(u *url.URL, entries []string) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip := net.ParseIP(host); ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+			if entryPort != port {
+				continue
+			}
+			entry = entryHost
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// postJSON sends the JSON body to endpoint with the given headers and fails unless it responds with a 2xx status.
+// The errors leave out the endpoint, webhook URLs contain their credentials.
+func postJSON(ctx context.Context, client *http.Client, endpoint string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", withoutURL(err))
+	}
+	maps.Copy(req.Header, header)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", withoutURL(err))
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s", ErrRequestRejected, resp.Status)
+	}
+	return nil
+}
+
+// withoutURL returns the cause of a *url.Error, whose message contains the full request URL
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}